@@ -1,39 +1,145 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"flag"
 	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"io"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"urlshortener/internal/auth"
+	"urlshortener/internal/config"
+	"urlshortener/internal/database"
 	"urlshortener/internal/handler"
 	"urlshortener/internal/middleware"
+	"urlshortener/internal/service"
 )
 
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Println("Usage: go run main.go <fixDomain>")
+	cfg, err := config.Load(os.Args[1:], os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		fmt.Print(config.Usage())
+		return
 	}
-	fixDomain := "http://localhost:8080"
-	if len(os.Args) > 1 {
-		fixDomain = os.Args[1]
+	if err != nil {
+		log.Fatalf("configuration error:\n%s", err)
 	}
-	log.Printf("Server to be started at 8080")
-	app := handler.NewApp(fixDomain)
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: cfg.LogLevel})))
+
+	db, err := database.Open(cfg.Store, cfg.DataFile)
+	if err != nil {
+		log.Fatalf("could not open the %s store: %s", cfg.Store, err)
+	}
+	if cfg.Store == database.FileStore {
+		log.Printf("Using file storage at %s", cfg.DataFile)
+	}
+
+	// a sequence resumes from the position kept in the store
+	codes, err := service.NewCodeGenerator(cfg.CodeGenerator, db)
+	if err != nil {
+		log.Fatalf("configuration error:\n%s", err)
+	}
+
+	log.Printf("Server to be started at %s", cfg.ListenAddr)
+	registry := prometheus.NewRegistry()
+	app := handler.NewApp(db, cfg.BaseDomain,
+		service.WithMetrics(registry),
+		service.WithDefaultExpiry(cfg.DefaultExpiry),
+		service.WithMaxExpiry(cfg.MaxExpiry),
+		service.WithReapInterval(cfg.ReapInterval),
+		service.WithTopDomainsInterval(cfg.TopDomainsInterval),
+		service.WithDomains(cfg.ShortDomains()...),
+		service.WithCodeLength(cfg.CodeLength),
+		service.WithCodeGenerator(codes),
+		service.WithBulkConcurrency(cfg.BulkConcurrency),
+		service.WithDefaultRedirect(cfg.RedirectStatus),
+		service.WithURLPolicy(cfg.URLPolicy()),
+		service.WithCanonicalization(cfg.Canonicalization()))
+	keys, err := cfg.Keys()
+	if err != nil {
+		log.Fatalf("configuration error:\n%s", err)
+	}
+	// creation and link management need an API key; redirects stay public
+	authenticate := func(h http.Handler) http.Handler { return h }
+	if len(keys) > 0 {
+		store, err := auth.NewStaticKeyStore(keys)
+		if err != nil {
+			log.Fatalf("configuration error:\n%s", err)
+		}
+		authenticate = middleware.APIKeyMiddleware(store)
+		log.Printf("API key authentication enabled with %d keys", store.Len())
+	} else {
+		log.Printf("WARNING: allow-anonymous-create is set and no API keys are configured, anyone can create links; link management and stats are disabled")
+	}
+	// per IP before authentication, then per key once the key is known
+	ipLimit := middleware.NewRateLimiter(middleware.RateLimit{PerMinute: cfg.IPRateLimit, Burst: cfg.IPBurst}).Middleware
+	createLimit := middleware.NewRateLimiter(middleware.RateLimit{PerMinute: cfg.CreateRateLimit, Burst: cfg.CreateBurst}).Middleware
+	protect := func(h http.Handler) http.Handler { return ipLimit(authenticate(createLimit(h))) }
+	// bulk requests pay one token of their own quota per link
+	bulkLimit := middleware.NewRateLimiter(middleware.RateLimit{PerMinute: cfg.BulkRateLimit, Burst: cfg.BulkBurst}).Middleware
+	redirectLimit := middleware.NewRateLimiter(middleware.RateLimit{PerMinute: cfg.RedirectRateLimit, Burst: cfg.RedirectBurst}).Middleware
 	mux := http.NewServeMux()
-	mux.HandleFunc("/shortURL", app.GenerateShortURL())
-	mux.HandleFunc("/{id}", app.RedirectHandler())
-	mux.HandleFunc("/metrics", app.Top3Domains())
+	mux.Handle("/shortURL", protect(app.GenerateShortURL()))
+	mux.Handle("/shortURL/bulk", protect(bulkLimit(app.BulkShortenHandler())))
+	mux.Handle("/{id}", redirectLimit(app.RedirectHandler()))
+	// links are managed by their owner, so without keys nobody can manage them
+	if len(keys) > 0 {
+		mux.Handle("/{id}/stats", protect(app.LinkStatsHandler()))
+		mux.Handle("/api/links/{id}", protect(app.LinkHandler()))
+	}
+	mux.HandleFunc("/metrics", app.TopDomains())
+	mux.Handle("GET /prometheus", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
 	srv := http.Server{
-		Addr:    ":8080",
-		Handler: middleware.LatencyMiddleware(mux),
+		Addr:    cfg.ListenAddr,
+		Handler: middleware.LatencyMiddleware(middleware.MetricsMiddleware(registry)(mux)),
 	}
-	log.Printf("Server is serving on 8080" +
-		"/shortURL - shorten the URL" +
-		"/{id} - for redirection" +
-		"/metrics -  for top3 Domains")
+	log.Printf("Server is serving on %s\n"+
+		"/shortURL - shorten the URL\n"+
+		"/shortURL/bulk - shorten a JSON array or NDJSON stream of URLs\n"+
+		"/{id} - for redirection\n"+
+		"/{id}/stats - click analytics of a link\n"+
+		"/api/links/{id} - get, update or delete a link\n"+
+		"/metrics - top domains, ?limit=N&window=1h|24h|7d\n"+
+		"/prometheus - Prometheus metrics", cfg.ListenAddr)
 
-	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.ListenAndServe()
+	}()
+	select {
+	case err := <-serveErr:
 		log.Fatalf("server error: %s", err)
+	case <-ctx.Done():
+	}
+	stop() // a second signal kills the process immediately
+
+	log.Printf("Shutting down, waiting up to %s", cfg.ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	exitCode := 0
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("could not drain in-flight requests: %s", err)
+		exitCode = 1
+	}
+	if err := app.Close(shutdownCtx); err != nil {
+		log.Printf("could not stop background jobs: %s", err)
+		exitCode = 1
+	}
+	if closer, ok := db.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Printf("could not close %s: %s", cfg.DataFile, err)
+			exitCode = 1
+		}
 	}
+	log.Printf("Server stopped")
+	os.Exit(exitCode)
 }
@@ -0,0 +1,143 @@
+// Package auth identifies API clients by their key. Keys are only ever kept
+// as SHA-256 hashes; a client is known by the non-secret ID paired with its key.
+package auth
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Key is one accepted API key: a stable ID recorded as the owner of the links
+// it creates and the hex encoded SHA-256 hash of the secret key.
+type Key struct {
+	ID   string
+	Hash string
+}
+
+// KeyStore resolves the hash of a presented key to the ID of its owner.
+type KeyStore interface {
+	LookupHash(ctx context.Context, hash string) (id string, ok bool)
+}
+
+// HashKey returns the hex encoded SHA-256 hash of a raw API key, the form in
+// which keys are configured and stored.
+func HashKey(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+// StaticKeyStore is a KeyStore over a fixed set of keys, typically loaded
+// from the configuration.
+type StaticKeyStore struct {
+	ids map[string]string // hash -> ID
+}
+
+func NewStaticKeyStore(keys []Key) (*StaticKeyStore, error) {
+	s := &StaticKeyStore{ids: make(map[string]string, len(keys))}
+	seen := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		if err := k.validate(); err != nil {
+			return nil, err
+		}
+		if seen[k.ID] {
+			return nil, fmt.Errorf("duplicate API key id %q", k.ID)
+		}
+		if _, ok := s.ids[k.Hash]; ok {
+			return nil, fmt.Errorf("API key %q reuses the key of %q", k.ID, s.ids[k.Hash])
+		}
+		seen[k.ID] = true
+		s.ids[k.Hash] = k.ID
+	}
+	return s, nil
+}
+
+func (s *StaticKeyStore) LookupHash(ctx context.Context, hash string) (string, bool) {
+	id, ok := s.ids[hash]
+	return id, ok
+}
+
+// Len returns the number of keys in the store.
+func (s *StaticKeyStore) Len() int {
+	return len(s.ids)
+}
+
+func (k Key) validate() error {
+	if k.ID == "" || strings.ContainsAny(k.ID, ": \t") {
+		return fmt.Errorf("invalid API key id %q", k.ID)
+	}
+	if len(k.Hash) != 2*sha256.Size {
+		return fmt.Errorf("API key %q: hash must be %d hex characters", k.ID, 2*sha256.Size)
+	}
+	if _, err := hex.DecodeString(k.Hash); err != nil {
+		return fmt.Errorf("API key %q: hash is not hex", k.ID)
+	}
+	return nil
+}
+
+// ParseKeys parses comma or newline separated "id:sha256hex" entries. Blank
+// entries and lines starting with # are ignored.
+func ParseKeys(spec string) ([]Key, error) {
+	var keys []Key
+	var errs []error
+	for _, line := range strings.FieldsFunc(spec, func(r rune) bool { return r == ',' || r == '\n' }) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		id, hash, ok := strings.Cut(line, ":")
+		if !ok {
+			errs = append(errs, fmt.Errorf("API key entry %q must be id:sha256hex", line))
+			continue
+		}
+		key := Key{ID: strings.TrimSpace(id), Hash: strings.ToLower(strings.TrimSpace(hash))}
+		if err := key.validate(); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys, errors.Join(errs...)
+}
+
+// LoadKeyFile reads a key store file holding one "id:sha256hex" entry per line.
+func LoadKeyFile(path string) ([]Key, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("API key file: %w", err)
+	}
+	defer f.Close()
+	var b strings.Builder
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		b.WriteString(scanner.Text())
+		b.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("API key file %s: %w", path, err)
+	}
+	keys, err := ParseKeys(b.String())
+	if err != nil {
+		return nil, fmt.Errorf("API key file %s: %w", path, err)
+	}
+	return keys, nil
+}
+
+type keyIDContextKey struct{}
+
+// WithKeyID returns a copy of ctx carrying the ID of the authenticated key.
+func WithKeyID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, keyIDContextKey{}, id)
+}
+
+// KeyID returns the ID of the key that authenticated the request, or "" when
+// the request was not authenticated.
+func KeyID(ctx context.Context) string {
+	id, _ := ctx.Value(keyIDContextKey{}).(string)
+	return id
+}
@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHashKey(t *testing.T) {
+	// sha256("secret")
+	assert.Equal(t, "2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b", HashKey("secret"))
+}
+
+func TestParseKeys(t *testing.T) {
+	keys, err := ParseKeys("ci:" + HashKey("a") + ", \n# comment\nops : " + strings.ToUpper(HashKey("b")) + "\n")
+	require.NoError(t, err)
+	assert.Equal(t, []Key{{ID: "ci", Hash: HashKey("a")}, {ID: "ops", Hash: HashKey("b")}}, keys)
+
+	keys, err = ParseKeys("")
+	assert.NoError(t, err)
+	assert.Empty(t, keys)
+
+	_, err = ParseKeys("ci," + "ops:abc,:" + HashKey("a") + ",bad:" + strings.Repeat("z", 64))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `"ci" must be id:sha256hex`)
+	assert.Contains(t, err.Error(), `"ops": hash must be 64 hex characters`)
+	assert.Contains(t, err.Error(), `invalid API key id ""`)
+	assert.Contains(t, err.Error(), `"bad": hash is not hex`)
+}
+
+func TestStaticKeyStore(t *testing.T) {
+	store, err := NewStaticKeyStore([]Key{{ID: "ci", Hash: HashKey("a")}, {ID: "ops", Hash: HashKey("b")}})
+	require.NoError(t, err)
+	assert.Equal(t, 2, store.Len())
+	id, ok := store.LookupHash(context.Background(), HashKey("b"))
+	assert.True(t, ok)
+	assert.Equal(t, "ops", id)
+	_, ok = store.LookupHash(context.Background(), HashKey("c"))
+	assert.False(t, ok)
+
+	_, err = NewStaticKeyStore([]Key{{ID: "ci", Hash: HashKey("a")}, {ID: "ci", Hash: HashKey("b")}})
+	assert.ErrorContains(t, err, `duplicate API key id "ci"`)
+	_, err = NewStaticKeyStore([]Key{{ID: "ci", Hash: HashKey("a")}, {ID: "ops", Hash: HashKey("a")}})
+	assert.ErrorContains(t, err, `"ops" reuses the key of "ci"`)
+}
+
+func TestLoadKeyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	require.NoError(t, os.WriteFile(path, []byte("# team keys\nci:"+HashKey("a")+"\n\nops:"+HashKey("b")+"\n"), 0o600))
+	keys, err := LoadKeyFile(path)
+	require.NoError(t, err)
+	assert.Len(t, keys, 2)
+
+	_, err = LoadKeyFile(filepath.Join(t.TempDir(), "missing"))
+	assert.ErrorContains(t, err, "API key file")
+}
+
+func TestKeyID(t *testing.T) {
+	ctx := context.Background()
+	assert.Equal(t, "", KeyID(ctx))
+	assert.Equal(t, "ci", KeyID(WithKeyID(ctx, "ci")))
+}
@@ -0,0 +1,543 @@
+// Package config loads the server configuration from defaults, an optional
+// YAML or JSON file, URLSHORTENER_* environment variables and command line
+// flags, in increasing order of precedence.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"urlshortener/internal/auth"
+	"urlshortener/internal/service"
+)
+
+// EnvPrefix prefixes the environment variable of every setting, e.g.
+// listen-addr is read from URLSHORTENER_LISTEN_ADDR.
+const EnvPrefix = "URLSHORTENER_"
+
+const DefaultShutdownTimeout = 10 * time.Second
+
+type Config struct {
+	ListenAddr         string
+	BaseDomain         string
+	Domains            string // comma separated base URLs of the other short domains
+	Store              string // memory, sharded or file
+	DataFile           string // journal used by the file store
+	DefaultExpiry      time.Duration
+	MaxExpiry          time.Duration
+	RedirectStatus     int
+	CodeLength         int
+	CodeGenerator      string // hash, sequence, random or readable
+	BulkConcurrency    int
+	ReapInterval       time.Duration
+	TopDomainsInterval time.Duration
+	ShutdownTimeout    time.Duration // deadline for draining requests and background jobs
+	APIKeys            string        // comma separated id:sha256hex entries
+	CreateRateLimit    int           // creation and management requests per minute per client, 0 for no limit
+	CreateBurst        int
+	IPRateLimit        int // creation and management requests per minute per IP, checked before the API key
+	IPBurst            int
+	RedirectRateLimit  int // redirects per minute per client, 0 for no limit
+	RedirectBurst      int
+	BulkRateLimit      int // links created by bulk requests per minute per client, 0 for no limit
+	BulkBurst          int
+	AllowDomains       string // comma separated host patterns, empty allows every host
+	DenyDomains        string
+	AllowAnonymous     bool   // let anyone create links when no API keys are configured
+	AllowPrivate       bool   // let links target loopback and private addresses
+	DenyIPHosts        bool   // refuse links whose host is an IP address
+	AllowPorts         string // comma separated ports links may name explicitly, empty allows any
+	SortQuery          bool   // sort query parameters of long URLs before deduplication
+	StripParams        string // comma separated query parameters removed from long URLs, utm_* matches a prefix
+	APIKeysFile        string // key store file with one id:sha256hex entry per line
+	LogLevel           slog.Level
+}
+
+// Default returns the configuration used when nothing is overridden.
+func Default() *Config {
+	return &Config{
+		ListenAddr:         ":8080",
+		BaseDomain:         "http://localhost:8080",
+		Store:              "memory",
+		DataFile:           "urlshortener.db",
+		DefaultExpiry:      service.DefaultExpiry,
+		RedirectStatus:     http.StatusPermanentRedirect,
+		CodeLength:         service.DefaultCodeLength,
+		CodeGenerator:      service.HashCodes,
+		BulkConcurrency:    service.DefaultBulkConcurrency,
+		ReapInterval:       service.DefaultReapInterval,
+		TopDomainsInterval: service.DefaultTopDomainsInterval,
+		ShutdownTimeout:    DefaultShutdownTimeout,
+		CreateRateLimit:    60,
+		CreateBurst:        10,
+		IPRateLimit:        120,
+		IPBurst:            20,
+		RedirectRateLimit:  600,
+		RedirectBurst:      100,
+		BulkRateLimit:      6000,
+		BulkBurst:          service.MaxBulkItems,
+		LogLevel:           slog.LevelInfo,
+	}
+}
+
+// setting binds one configuration key to its flag, environment variable and
+// file key, which all share the same name and string syntax.
+type setting struct {
+	name  string
+	usage string
+	set   func(c *Config, value string) error
+	get   func(c *Config) string
+	bool  bool // flag may be given without a value
+}
+
+var settings = []setting{
+	stringSetting("listen-addr", "address the HTTP server listens on", func(c *Config) *string { return &c.ListenAddr }),
+	stringSetting("base-domain", "public base URL of short links", func(c *Config) *string { return &c.BaseDomain }),
+	stringSetting("domains", "comma separated base URLs of further short domains, each with its own codes", func(c *Config) *string { return &c.Domains }),
+	stringSetting("store", "storage backend: memory, sharded (in memory, for high redirect volume) or file", func(c *Config) *string { return &c.Store }),
+	stringSetting("data", "journal file used by the file storage backend", func(c *Config) *string { return &c.DataFile }),
+	durationSetting("default-expiry", "lifetime of links created without an explicit expiry, 0 for never", func(c *Config) *time.Duration { return &c.DefaultExpiry }),
+	durationSetting("max-expiry", "longest expiry a client may request, 0 for no limit", func(c *Config) *time.Duration { return &c.MaxExpiry }),
+	intSetting("redirect-status", "default redirect status for new links: 301, 302, 307 or 308", func(c *Config) *int { return &c.RedirectStatus }),
+	intSetting("code-length", "length of generated short codes", func(c *Config) *int { return &c.CodeLength }),
+	stringSetting("code-generator", "how short codes are generated: hash, sequence, random or readable", func(c *Config) *string { return &c.CodeGenerator }),
+	intSetting("bulk-concurrency", "links of a bulk request shortened in parallel", func(c *Config) *int { return &c.BulkConcurrency }),
+	durationSetting("reap-interval", "how often expired links are purged", func(c *Config) *time.Duration { return &c.ReapInterval }),
+	durationSetting("top-domains-interval", "how often the top domains ranking is refreshed", func(c *Config) *time.Duration { return &c.TopDomainsInterval }),
+	durationSetting("shutdown-timeout", "how long to wait for in-flight requests and background jobs on SIGINT or SIGTERM", func(c *Config) *time.Duration { return &c.ShutdownTimeout }),
+	stringSetting("api-keys", "comma separated id:sha256hex API keys required to create links", func(c *Config) *string { return &c.APIKeys }),
+	stringSetting("api-keys-file", "file with one id:sha256hex API key per line", func(c *Config) *string { return &c.APIKeysFile }),
+	boolSetting("allow-anonymous-create", "run without API keys, letting anyone create links; link management and stats are then disabled", func(c *Config) *bool { return &c.AllowAnonymous }),
+	intSetting("create-rate-limit", "link creation and management requests per minute per API key or IP, 0 for no limit", func(c *Config) *int { return &c.CreateRateLimit }),
+	intSetting("create-burst", "requests a client may send at once before create-rate-limit applies", func(c *Config) *int { return &c.CreateBurst }),
+	intSetting("ip-rate-limit", "creation and management requests per minute per IP, checked before the API key, 0 for no limit", func(c *Config) *int { return &c.IPRateLimit }),
+	intSetting("ip-burst", "requests an IP may send at once before ip-rate-limit applies", func(c *Config) *int { return &c.IPBurst }),
+	intSetting("redirect-rate-limit", "redirects per minute per IP, 0 for no limit", func(c *Config) *int { return &c.RedirectRateLimit }),
+	intSetting("redirect-burst", "redirects a client may follow at once before redirect-rate-limit applies", func(c *Config) *int { return &c.RedirectBurst }),
+	intSetting("bulk-rate-limit", "links created by bulk requests per minute per API key or IP, 0 for no limit", func(c *Config) *int { return &c.BulkRateLimit }),
+	intSetting("bulk-burst", "links a client may create at once with bulk requests before bulk-rate-limit applies", func(c *Config) *int { return &c.BulkBurst }),
+	stringSetting("allow-domains", "comma separated hosts links may point to, *.example.com matches subdomains; empty allows all", func(c *Config) *string { return &c.AllowDomains }),
+	stringSetting("deny-domains", "comma separated hosts links may never point to, *.example.com matches subdomains", func(c *Config) *string { return &c.DenyDomains }),
+	boolSetting("allow-private-targets", "allow links to loopback, private and link-local addresses", func(c *Config) *bool { return &c.AllowPrivate }),
+	boolSetting("deny-ip-hosts", "refuse links whose host is an IP address instead of a domain name", func(c *Config) *bool { return &c.DenyIPHosts }),
+	stringSetting("allow-ports", "comma separated ports links may name explicitly; empty allows any port", func(c *Config) *string { return &c.AllowPorts }),
+	boolSetting("sort-query", "sort the query parameters of long URLs so their order does not create new links", func(c *Config) *bool { return &c.SortQuery }),
+	stringSetting("strip-params", "comma separated query parameters removed from long URLs, utm_* matches a prefix", func(c *Config) *string { return &c.StripParams }),
+	{
+		name:  "log-level",
+		usage: "minimum log level: debug, info, warn or error",
+		set:   func(c *Config, v string) error { return c.LogLevel.UnmarshalText([]byte(v)) },
+		get:   func(c *Config) string { return strings.ToLower(c.LogLevel.String()) },
+	},
+}
+
+func stringSetting(name, usage string, field func(c *Config) *string) setting {
+	return setting{
+		name:  name,
+		usage: usage,
+		set: func(c *Config, v string) error {
+			*field(c) = v
+			return nil
+		},
+		get: func(c *Config) string { return *field(c) },
+	}
+}
+
+func durationSetting(name, usage string, field func(c *Config) *time.Duration) setting {
+	return setting{
+		name:  name,
+		usage: usage,
+		set: func(c *Config, v string) error {
+			d, err := service.ParseTTL(v)
+			if err != nil {
+				return fmt.Errorf("%q is not a duration such as 90s, 36h or 7d", v)
+			}
+			*field(c) = d
+			return nil
+		},
+		get: func(c *Config) string { return field(c).String() },
+	}
+}
+
+func intSetting(name, usage string, field func(c *Config) *int) setting {
+	return setting{
+		name:  name,
+		usage: usage,
+		set: func(c *Config, v string) error {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("%q is not an integer", v)
+			}
+			*field(c) = n
+			return nil
+		},
+		get: func(c *Config) string { return strconv.Itoa(*field(c)) },
+	}
+}
+
+func boolSetting(name, usage string, field func(c *Config) *bool) setting {
+	return setting{
+		name:  name,
+		usage: usage,
+		set: func(c *Config, v string) error {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("%q is not a boolean", v)
+			}
+			*field(c) = b
+			return nil
+		},
+		get:  func(c *Config) string { return strconv.FormatBool(*field(c)) },
+		bool: true,
+	}
+}
+
+func lookupSetting(name string) *setting {
+	for i := range settings {
+		if settings[i].name == name {
+			return &settings[i]
+		}
+	}
+	return nil
+}
+
+func envName(name string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// Load builds the configuration from args (without the program name) and the
+// environment read through getenv. The config file is named by -config or
+// URLSHORTENER_CONFIG. A positional argument, kept for compatibility, sets the
+// base domain. It returns flag.ErrHelp when -h was requested.
+func Load(args []string, getenv func(string) string) (*Config, error) {
+	fs := flag.NewFlagSet("urlshortener", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	configFile := fs.String("config", getenv(EnvPrefix+"CONFIG"), "optional YAML or JSON configuration file")
+	flagValues := map[string]string{}
+	var flagOrder []string
+	defaults := Default()
+	for _, s := range settings {
+		name := s.name
+		define := fs.Func
+		if s.bool {
+			define = fs.BoolFunc
+		}
+		define(name, s.usage+" (env "+envName(name)+")", func(v string) error {
+			if err := s.set(defaults.clone(), v); err != nil {
+				return err
+			}
+			if _, seen := flagValues[name]; !seen {
+				flagOrder = append(flagOrder, name)
+			}
+			flagValues[name] = v
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w\n%s", err, Usage())
+	}
+	if fs.NArg() > 1 {
+		return nil, fmt.Errorf("unexpected arguments %q, only the base domain may be positional", fs.Args()[1:])
+	}
+
+	cfg := Default()
+	if *configFile != "" {
+		if err := cfg.loadFile(*configFile); err != nil {
+			return nil, err
+		}
+	}
+	var errs []error
+	for _, s := range settings {
+		if v := getenv(envName(s.name)); v != "" {
+			if err := s.set(cfg, v); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", envName(s.name), err))
+			}
+		}
+	}
+	for _, name := range flagOrder {
+		// values were checked while parsing
+		_ = lookupSetting(name).set(cfg, flagValues[name])
+	}
+	if fs.NArg() == 1 {
+		cfg.BaseDomain = fs.Arg(0)
+	}
+	cfg.BaseDomain = strings.TrimSuffix(cfg.BaseDomain, "/")
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *Config) clone() *Config {
+	copied := *c
+	return &copied
+}
+
+// loadFile applies a YAML (.yaml, .yml) or JSON (.json) file whose keys are
+// the setting names, e.g. `listen-addr: ":9090"`.
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config file: %w", err)
+	}
+	values := map[string]any{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		err = decoder.Decode(&values)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &values)
+	default:
+		return fmt.Errorf("config file %s: unsupported extension, use .yaml, .yml or .json", path)
+	}
+	if err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	var errs []error
+	for key, value := range values {
+		s := lookupSetting(key)
+		if s == nil {
+			errs = append(errs, fmt.Errorf("config file %s: unknown key %q", path, key))
+			continue
+		}
+		switch value.(type) {
+		case map[string]any, []any, nil:
+			errs = append(errs, fmt.Errorf("config file %s: %s must be a single value", path, key))
+			continue
+		}
+		if err := s.set(c, fmt.Sprint(value)); err != nil {
+			errs = append(errs, fmt.Errorf("config file %s: %s: %w", path, key, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Validate reports every invalid setting at once.
+func (c *Config) Validate() error {
+	var errs []error
+	invalid := func(name, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("invalid %s: %s", name, fmt.Sprintf(format, args...)))
+	}
+	if _, _, err := net.SplitHostPort(c.ListenAddr); err != nil {
+		invalid("listen-addr", "%q is not host:port", c.ListenAddr)
+	}
+	if u, err := url.Parse(c.BaseDomain); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		invalid("base-domain", "%q must be an absolute http(s) URL", c.BaseDomain)
+	}
+	// domains are told apart the way the service registers them
+	hosts := map[string]string{service.DomainHost(c.BaseDomain): c.BaseDomain}
+	for _, domain := range c.ShortDomains() {
+		if !validBaseURL(domain) {
+			invalid("domains", "%q must be an absolute http(s) URL without a path", domain)
+			continue
+		}
+		host := service.DomainHost(domain)
+		if other, ok := hosts[host]; ok {
+			invalid("domains", "%s is listed twice, as %s and %s", host, other, domain)
+		}
+		hosts[host] = domain
+	}
+	switch c.Store {
+	case "memory", "sharded":
+	case "file":
+		if c.DataFile == "" {
+			invalid("data", "a journal path is required by the file store")
+		}
+	default:
+		invalid("store", "%q must be memory, sharded or file", c.Store)
+	}
+	if c.DefaultExpiry < 0 {
+		invalid("default-expiry", "must not be negative")
+	}
+	if c.MaxExpiry < 0 {
+		invalid("max-expiry", "must not be negative")
+	}
+	if c.MaxExpiry > 0 && (c.DefaultExpiry == 0 || c.DefaultExpiry > c.MaxExpiry) {
+		invalid("default-expiry", "%s must be non-zero and within max-expiry %s", c.DefaultExpiry, c.MaxExpiry)
+	}
+	if !service.ValidRedirectStatus(c.RedirectStatus) {
+		invalid("redirect-status", "%d must be one of 301, 302, 307 or 308", c.RedirectStatus)
+	}
+	if c.CodeLength < service.MinCodeLength || c.CodeLength > service.UpperBoundEncodedLength {
+		invalid("code-length", "%d must be between %d and %d", c.CodeLength, service.MinCodeLength, service.UpperBoundEncodedLength)
+	}
+	if _, err := service.NewCodeGenerator(c.CodeGenerator, nil); err != nil {
+		invalid("code-generator", "%s", err)
+	}
+	if c.BulkConcurrency < 1 {
+		invalid("bulk-concurrency", "%d must be at least 1", c.BulkConcurrency)
+	}
+	if c.ReapInterval <= 0 {
+		invalid("reap-interval", "must be positive")
+	}
+	if c.TopDomainsInterval <= 0 {
+		invalid("top-domains-interval", "must be positive")
+	}
+	if c.ShutdownTimeout <= 0 {
+		invalid("shutdown-timeout", "must be positive")
+	}
+	for _, limit := range []struct {
+		name         string
+		rate, burst  int
+		burstSetting string
+	}{
+		{"create-rate-limit", c.CreateRateLimit, c.CreateBurst, "create-burst"},
+		{"ip-rate-limit", c.IPRateLimit, c.IPBurst, "ip-burst"},
+		{"redirect-rate-limit", c.RedirectRateLimit, c.RedirectBurst, "redirect-burst"},
+	} {
+		if limit.rate < 0 {
+			invalid(limit.name, "must not be negative")
+		}
+		if limit.rate > 0 && limit.burst < 1 {
+			invalid(limit.burstSetting, "%d must be at least 1", limit.burst)
+		}
+	}
+	if c.BulkRateLimit < 0 {
+		invalid("bulk-rate-limit", "must not be negative")
+	}
+	// a streamed bulk request pays for a whole batch at once
+	if c.BulkRateLimit > 0 && c.BulkBurst < service.BulkBatchSize {
+		invalid("bulk-burst", "%d must be at least %d, the batch size of streamed bulk requests", c.BulkBurst, service.BulkBatchSize)
+	}
+	for _, list := range []struct{ name, patterns string }{
+		{"allow-domains", c.AllowDomains},
+		{"deny-domains", c.DenyDomains},
+	} {
+		for _, pattern := range splitList(list.patterns) {
+			if err := service.ValidateHostPattern(pattern); err != nil {
+				invalid(list.name, "%s", err)
+			}
+		}
+	}
+	if _, err := c.ports(); err != nil {
+		invalid("allow-ports", "%s", err)
+	}
+	for _, pattern := range splitList(c.StripParams) {
+		if err := service.ValidateParamPattern(pattern); err != nil {
+			invalid("strip-params", "%s", err)
+		}
+	}
+	if keys, err := c.Keys(); err != nil {
+		errs = append(errs, err)
+	} else if len(keys) == 0 && !c.AllowAnonymous {
+		invalid("api-keys", "no API keys are configured; set api-keys or api-keys-file, or allow-anonymous-create to let anyone create links")
+	}
+	return errors.Join(errs...)
+}
+
+// Keys returns the API keys of api-keys and api-keys-file. No keys means
+// authentication is disabled, which allow-anonymous-create has to allow.
+func (c *Config) Keys() ([]auth.Key, error) {
+	keys, err := auth.ParseKeys(c.APIKeys)
+	if err != nil {
+		return nil, fmt.Errorf("invalid api-keys: %w", err)
+	}
+	if c.APIKeysFile != "" {
+		fileKeys, err := auth.LoadKeyFile(c.APIKeysFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid api-keys-file: %w", err)
+		}
+		keys = append(keys, fileKeys...)
+	}
+	if _, err := auth.NewStaticKeyStore(keys); err != nil {
+		return nil, fmt.Errorf("invalid api keys: %w", err)
+	}
+	return keys, nil
+}
+
+// ShortDomains returns the short domains served besides base-domain.
+func (c *Config) ShortDomains() []string {
+	domains := splitList(c.Domains)
+	for i, domain := range domains {
+		domains[i] = strings.TrimSuffix(domain, "/")
+	}
+	return domains
+}
+
+// validBaseURL reports whether base is an absolute http(s) URL naming only a host.
+func validBaseURL(base string) bool {
+	u, err := url.Parse(base)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" &&
+		(u.Path == "" || u.Path == "/") && u.RawQuery == "" && u.Fragment == ""
+}
+
+// URLPolicy returns the policy applied to long URLs.
+func (c *Config) URLPolicy() service.URLPolicy {
+	ports, _ := c.ports() // checked by Validate
+	return service.URLPolicy{
+		Allow:        splitList(c.AllowDomains),
+		Deny:         splitList(c.DenyDomains),
+		AllowPrivate: c.AllowPrivate,
+		DenyIPHosts:  c.DenyIPHosts,
+		Ports:        ports,
+	}
+}
+
+// ports parses allow-ports.
+func (c *Config) ports() ([]int, error) {
+	var ports []int
+	for _, item := range splitList(c.AllowPorts) {
+		port, err := strconv.Atoi(item)
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("%q is not a port number", item)
+		}
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
+
+// Canonicalization returns the optional canonicalization applied to long URLs.
+func (c *Config) Canonicalization() service.Canonicalization {
+	return service.Canonicalization{
+		SortQuery:   c.SortQuery,
+		StripParams: splitList(c.StripParams),
+	}
+}
+
+// splitList splits a comma separated setting, dropping blank entries.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Usage describes every setting with its flag, environment variable and default.
+func Usage() string {
+	var b strings.Builder
+	b.WriteString("Usage: urlshortener [flags] [base-domain]\n\n")
+	b.WriteString("  -config string\n\toptional YAML or JSON configuration file (env " + EnvPrefix + "CONFIG)\n")
+	defaults := Default()
+	for _, s := range settings {
+		value := s.get(defaults)
+		if value == "" {
+			value = "none"
+		}
+		fmt.Fprintf(&b, "  -%s\n\t%s (env %s, default %s)\n", s.name, s.usage, envName(s.name), value)
+	}
+	b.WriteString("\nPrecedence: flags > environment > config file > defaults.\n")
+	return b.String()
+}
@@ -0,0 +1,183 @@
+package config
+
+import (
+	"flag"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"urlshortener/internal/auth"
+	"urlshortener/internal/service"
+)
+
+func env(vars map[string]string) func(string) string {
+	return func(key string) string { return vars[key] }
+}
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	return path
+}
+
+func TestLoad_Defaults(t *testing.T) {
+	_, err := Load(nil, env(nil))
+	assert.ErrorContains(t, err, "invalid api-keys: no API keys are configured", "authentication is required by default")
+
+	cfg, err := Load([]string{"-allow-anonymous-create"}, env(nil))
+	require.NoError(t, err)
+	want := Default()
+	want.AllowAnonymous = true
+	assert.Equal(t, want, cfg)
+}
+
+func TestLoad_Precedence(t *testing.T) {
+	file := writeFile(t, "config.yaml", `
+listen-addr: ":7000"
+base-domain: https://file.example/
+store: file
+data: /tmp/file.db
+code-length: 8
+default-expiry: 30d
+log-level: debug
+`)
+	vars := map[string]string{
+		"URLSHORTENER_CONFIG":                 file,
+		"URLSHORTENER_LISTEN_ADDR":            ":7001",
+		"URLSHORTENER_CODE_LENGTH":            "7",
+		"URLSHORTENER_ALLOW_ANONYMOUS_CREATE": "true",
+	}
+	cfg, err := Load([]string{"-listen-addr", ":7002"}, env(vars))
+	require.NoError(t, err)
+	assert.Equal(t, ":7002", cfg.ListenAddr, "flag beats env and file")
+	assert.Equal(t, 7, cfg.CodeLength, "env beats file")
+	assert.Equal(t, "https://file.example", cfg.BaseDomain, "file beats default, trailing slash trimmed")
+	assert.Equal(t, "file", cfg.Store)
+	assert.Equal(t, "/tmp/file.db", cfg.DataFile)
+	assert.Equal(t, 30*24*time.Hour, cfg.DefaultExpiry)
+	assert.Equal(t, slog.LevelDebug, cfg.LogLevel)
+	assert.Equal(t, http.StatusPermanentRedirect, cfg.RedirectStatus, "untouched settings keep their default")
+
+	// -config overrides URLSHORTENER_CONFIG and the positional base domain is still honoured
+	other := writeFile(t, "other.json", `{"reap-interval": "5m", "redirect-status": 302}`)
+	cfg, err = Load([]string{"-config", other, "https://positional.example"}, env(vars))
+	require.NoError(t, err)
+	assert.Equal(t, 5*time.Minute, cfg.ReapInterval)
+	assert.Equal(t, http.StatusFound, cfg.RedirectStatus)
+	assert.Equal(t, ":7001", cfg.ListenAddr, "env still applies")
+	assert.Equal(t, "https://positional.example", cfg.BaseDomain)
+}
+
+func TestLoad_Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		vars map[string]string
+		file string
+		want []string
+	}{
+		{name: "bad flag value", args: []string{"-code-length", "six"}, want: []string{`invalid value "six" for flag -code-length`}},
+		{name: "unknown flag", args: []string{"-port", "80"}, want: []string{"flag provided but not defined: -port"}},
+		{name: "bad env value", vars: map[string]string{"URLSHORTENER_REAP_INTERVAL": "often"}, want: []string{"URLSHORTENER_REAP_INTERVAL", `"often" is not a duration`}},
+		{name: "unknown file key", file: "port: 80\n", want: []string{`unknown key "port"`}},
+		{name: "nested file value", file: "store:\n  kind: file\n", want: []string{"store must be a single value"}},
+		{
+			name: "validation reports every problem",
+			args: []string{"-store", "redis", "-code-length", "2", "-redirect-status", "200", "-listen-addr", "8080", "-reap-interval", "0", "not-a-url"},
+			want: []string{"invalid store", "invalid code-length", "invalid redirect-status", "invalid listen-addr", "invalid reap-interval", "invalid base-domain"},
+		},
+		{name: "default above max", args: []string{"-max-expiry", "24h"}, want: []string{"invalid default-expiry"}},
+		{name: "rate limit without burst", args: []string{"-create-burst", "0", "-redirect-rate-limit", "-1", "-ip-burst", "0", "-bulk-burst", "100"}, want: []string{"invalid create-burst", "invalid redirect-rate-limit", "invalid ip-burst", "invalid bulk-burst"}},
+		{name: "bad host pattern", args: []string{"-deny-domains", "evil.com, https://bad.com"}, want: []string{"invalid deny-domains", `"https://bad.com"`}},
+		{name: "bad boolean", args: []string{"-allow-private-targets=maybe"}, want: []string{`"maybe" is not a boolean`}},
+		{name: "unknown code generator", args: []string{"-code-generator", "uuid"}, want: []string{`invalid code-generator: unknown code generator "uuid"`}},
+		{name: "bad port", args: []string{"-allow-ports", "443, 70000"}, want: []string{`invalid allow-ports: "70000" is not a port number`}},
+		{name: "bad strip param", args: []string{"-strip-params", "utm_*, *, a*b"}, want: []string{`invalid strip-params`, `"*"`, `"a*b"`}},
+		{name: "bad short domain", args: []string{"-domains", "https://b.co/x, b.co"}, want: []string{`invalid domains: "https://b.co/x"`, `invalid domains: "b.co"`}},
+		{name: "duplicate short domain", args: []string{"-domains", "http://localhost:8080"}, want: []string{"localhost:8080 is listed twice"}},
+		{name: "same host on its default port", args: []string{"-domains", "https://b.co, https://b.co:443/"}, want: []string{"b.co is listed twice, as https://b.co and https://b.co:443"}},
+		{name: "same host for both schemes", args: []string{"-domains", "http://b.co, https://b.co"}, want: []string{"b.co is listed twice"}},
+		{name: "too many positionals", args: []string{"https://a.example", "extra"}, want: []string{"unexpected arguments"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vars := tt.vars
+			if tt.file != "" {
+				vars = map[string]string{"URLSHORTENER_CONFIG": writeFile(t, "config.yml", tt.file)}
+			}
+			_, err := Load(tt.args, env(vars))
+			require.Error(t, err)
+			for _, want := range tt.want {
+				assert.Contains(t, err.Error(), want)
+			}
+		})
+	}
+}
+
+func TestLoad_FileErrors(t *testing.T) {
+	_, err := Load([]string{"-config", filepath.Join(t.TempDir(), "missing.yaml")}, env(nil))
+	assert.ErrorContains(t, err, "config file")
+	_, err = Load([]string{"-config", writeFile(t, "config.toml", "")}, env(nil))
+	assert.ErrorContains(t, err, "unsupported extension")
+	_, err = Load([]string{"-config", writeFile(t, "config.json", "{")}, env(nil))
+	assert.ErrorContains(t, err, "config.json")
+}
+
+func TestLoad_Help(t *testing.T) {
+	_, err := Load([]string{"-h"}, env(nil))
+	assert.ErrorIs(t, err, flag.ErrHelp)
+	usage := Usage()
+	assert.Contains(t, usage, "-listen-addr")
+	assert.Contains(t, usage, "URLSHORTENER_LISTEN_ADDR")
+	assert.Contains(t, usage, "default :8080")
+}
+
+func TestLoad_APIKeys(t *testing.T) {
+	hash := "2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b"
+	file := writeFile(t, "keys", "ops:"+strings.Repeat("a", 64)+"\n")
+	cfg, err := Load([]string{"-api-keys", "ci:" + hash, "-api-keys-file", file}, env(nil))
+	require.NoError(t, err)
+	keys, err := cfg.Keys()
+	require.NoError(t, err)
+	assert.Equal(t, []auth.Key{{ID: "ci", Hash: hash}, {ID: "ops", Hash: strings.Repeat("a", 64)}}, keys)
+
+	_, err = Load([]string{"-api-keys", "ci:nothex"}, env(nil))
+	assert.ErrorContains(t, err, "invalid api-keys")
+	_, err = Load([]string{"-api-keys", "ops:" + hash, "-api-keys-file", file}, env(nil))
+	assert.ErrorContains(t, err, `duplicate API key id "ops"`)
+}
+
+func TestConfig_URLPolicy(t *testing.T) {
+	cfg, err := Load([]string{"-allow-anonymous-create", "-allow-domains", "example.com, *.example.com,", "-deny-domains", "bad.example.com", "-allow-private-targets", "-deny-ip-hosts", "-allow-ports", "8080, 8443"}, env(nil))
+	require.NoError(t, err)
+	assert.Equal(t, service.URLPolicy{
+		Allow:        []string{"example.com", "*.example.com"},
+		Deny:         []string{"bad.example.com"},
+		AllowPrivate: true,
+		DenyIPHosts:  true,
+		Ports:        []int{8080, 8443},
+	}, cfg.URLPolicy())
+}
+
+func TestConfig_ShortDomains(t *testing.T) {
+	cfg, err := Load([]string{"-allow-anonymous-create", "-domains", "https://b.co/, https://c.co"}, env(nil))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"https://b.co", "https://c.co"}, cfg.ShortDomains())
+
+	// a port that is not the scheme's default names another domain
+	cfg, err = Load([]string{"-allow-anonymous-create", "-domains", "https://b.co, https://b.co:80"}, env(nil))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"https://b.co", "https://b.co:80"}, cfg.ShortDomains())
+}
+
+func TestConfig_Canonicalization(t *testing.T) {
+	cfg, err := Load([]string{"-allow-anonymous-create", "-sort-query"}, env(map[string]string{"URLSHORTENER_STRIP_PARAMS": "utm_*, fbclid"}))
+	require.NoError(t, err)
+	assert.Equal(t, service.Canonicalization{SortQuery: true, StripParams: []string{"utm_*", "fbclid"}}, cfg.Canonicalization())
+}
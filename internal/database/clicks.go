@@ -0,0 +1,61 @@
+package database
+
+import (
+	"context"
+	"maps"
+	"urlshortener/internal/entities"
+)
+
+// RecordClicks folds a batch of clicks into the per-link aggregates. Clicks
+// for links that no longer exist are dropped.
+func (db *InMemoryDatabase) RecordClicks(ctx context.Context, clicks []entities.Click) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, click := range clicks {
+		if _, ok := db.shortUrlDB[click.Code]; !ok {
+			continue
+		}
+		addClick(db.clicksDB, click)
+	}
+	return nil
+}
+
+// RetrieveClickStats returns a copy of the click aggregates of key, or nil if
+// the link has never been followed.
+func (db *InMemoryDatabase) RetrieveClickStats(ctx context.Context, key string) *entities.ClickStats {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return cloneClickStats(db.clicksDB[key])
+}
+
+// addClick counts click in the aggregates of its link.
+func addClick(clicksDB map[string]*entities.ClickStats, click entities.Click) {
+	stats, ok := clicksDB[click.Code]
+	if !ok {
+		stats = &entities.ClickStats{
+			Daily:     map[string]int{},
+			Referrers: map[string]int{},
+			Devices:   map[string]int{},
+			Browsers:  map[string]int{},
+		}
+		clicksDB[click.Code] = stats
+	}
+	stats.Total++
+	stats.Daily[click.Time.UTC().Format("2006-01-02")]++
+	stats.Referrers[click.Referrer]++
+	stats.Devices[click.Device]++
+	stats.Browsers[click.Browser]++
+}
+
+func cloneClickStats(stats *entities.ClickStats) *entities.ClickStats {
+	if stats == nil {
+		return nil
+	}
+	return &entities.ClickStats{
+		Total:     stats.Total,
+		Daily:     maps.Clone(stats.Daily),
+		Referrers: maps.Clone(stats.Referrers),
+		Devices:   maps.Clone(stats.Devices),
+		Browsers:  maps.Clone(stats.Browsers),
+	}
+}
@@ -0,0 +1,578 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"urlshortener/internal/entities"
+)
+
+// backends lists every DB implementation the conformance suite runs against.
+var backends = map[string]func(t *testing.T) DB{
+	"memory": func(t *testing.T) DB {
+		return NewInMemoryDatabase()
+	},
+	"sharded": func(t *testing.T) DB {
+		// few shards, so that tests also cover keys sharing a shard
+		return NewShardedDatabase(4)
+	},
+	"file": func(t *testing.T) DB {
+		db, err := NewFileDatabase(filepath.Join(t.TempDir(), "urls.db"))
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = db.Close() })
+		return db
+	},
+}
+
+func sampleData(code, longURL, domain string) entities.ShortURLDBData {
+	now := time.Now().UTC().Truncate(time.Second)
+	return entities.ShortURLDBData{
+		LongURL:       longURL,
+		Domain:        "http://localhost:8080",
+		LongURLDomain: domain,
+		ShortURl:      code,
+		CreatedAt:     now,
+		ExpiryDate:    now.AddDate(0, 0, 7),
+	}
+}
+
+// Test that every backend honours the DB contract
+func TestDB_Conformance(t *testing.T) {
+	for name, newDB := range backends {
+		t.Run(name, func(t *testing.T) {
+			t.Run("AddAndRetrieve", func(t *testing.T) {
+				db := newDB(t)
+				ctx := context.Background()
+				data := sampleData("ABC123", "https://www.reddit.com/r/Fedora/", "www.reddit.com")
+				require.NoError(t, db.AddData(ctx, "ABC123", data))
+
+				got := db.RetrieveData(ctx, "ABC123")
+				require.NotNil(t, got)
+				assert.Equal(t, data.LongURL, got.LongURL)
+				assert.Equal(t, data.ShortURl, got.ShortURl)
+				assert.True(t, data.ExpiryDate.Equal(got.ExpiryDate))
+				assert.Equal(t, "ABC123", db.RetrieveDuplicateURL(ctx, data.LongURL))
+			})
+			t.Run("MissingKeys", func(t *testing.T) {
+				db := newDB(t)
+				ctx := context.Background()
+				assert.Nil(t, db.RetrieveData(ctx, "NOPE"))
+				assert.Equal(t, "", db.RetrieveDuplicateURL(ctx, "https://example.com"))
+				assert.NoError(t, db.CheckDuplicateRequest(ctx, "NOPE"))
+			})
+			t.Run("DuplicateKeyRejected", func(t *testing.T) {
+				db := newDB(t)
+				ctx := context.Background()
+				require.NoError(t, db.AddData(ctx, "ABC123", sampleData("ABC123", "https://a.com/1", "a.com")))
+				assert.ErrorIs(t, db.AddData(ctx, "ABC123", sampleData("ABC123", "https://b.com/1", "b.com")), ErrURLAlreadyShortened)
+				// store must remain usable after a rejected write
+				assert.Equal(t, "https://a.com/1", db.RetrieveData(ctx, "ABC123").LongURL)
+				assert.Error(t, db.CheckDuplicateRequest(ctx, "ABC123"))
+			})
+			t.Run("DomainCounters", func(t *testing.T) {
+				db := newDB(t)
+				ctx := context.Background()
+				adds := []entities.ShortURLDBData{
+					sampleData("A1", "https://a.com/1", "a.com"),
+					sampleData("A2", "https://a.com/2", "a.com"),
+					sampleData("A3", "https://a.com/3", "a.com"),
+					sampleData("B1", "https://b.com/1", "b.com"),
+					sampleData("B2", "https://b.com/2", "b.com"),
+					sampleData("C1", "https://c.com/1", "c.com"),
+					sampleData("D1", "https://d.com/1", "d.com"),
+				}
+				for _, data := range adds {
+					require.NoError(t, db.AddData(ctx, data.ShortURl, data))
+				}
+				db.PopulateTopDomains(ctx, time.Now())
+				top := db.RetrieveTopDomains(ctx, 3, 0)
+				require.Len(t, top, 3)
+				assert.Equal(t, entities.TopDomains{Domain: "a.com", Count: 3}, top[0])
+				assert.Equal(t, entities.TopDomains{Domain: "b.com", Count: 2}, top[1])
+				assert.Equal(t, 1, top[2].Count)
+			})
+			t.Run("TopDomainWindows", func(t *testing.T) {
+				db := newDB(t)
+				ctx := context.Background()
+				now := time.Now()
+				created := func(code, domain string, age time.Duration) {
+					data := sampleData(code, "https://"+domain+"/"+code, domain)
+					data.CreatedAt = now.Add(-age)
+					require.NoError(t, db.AddData(ctx, code, data))
+				}
+				// old.com dominates all time, new.com is trending
+				for i, age := range []time.Duration{30 * 24 * time.Hour, 20 * 24 * time.Hour, 10 * 24 * time.Hour, 3 * 24 * time.Hour} {
+					created(fmt.Sprintf("OLD%d", i), "old.com", age)
+				}
+				created("NEW1", "new.com", 10*time.Minute)
+				created("NEW2", "new.com", 20*time.Minute)
+				created("NEW3", "new.com", 5*time.Hour)
+				created("MID1", "mid.com", 2*24*time.Hour)
+				db.PopulateTopDomains(ctx, now)
+
+				assert.Equal(t, []entities.TopDomains{{Domain: "old.com", Count: 4}, {Domain: "new.com", Count: 3}, {Domain: "mid.com", Count: 1}}, db.RetrieveTopDomains(ctx, 10, 0))
+				assert.Equal(t, []entities.TopDomains{{Domain: "new.com", Count: 2}}, db.RetrieveTopDomains(ctx, 10, time.Hour))
+				assert.Equal(t, []entities.TopDomains{{Domain: "new.com", Count: 3}}, db.RetrieveTopDomains(ctx, 10, 24*time.Hour))
+				assert.Equal(t, []entities.TopDomains{{Domain: "new.com", Count: 3}, {Domain: "mid.com", Count: 1}, {Domain: "old.com", Count: 1}}, db.RetrieveTopDomains(ctx, 10, 7*24*time.Hour))
+				assert.Equal(t, []entities.TopDomains{{Domain: "old.com", Count: 4}}, db.RetrieveTopDomains(ctx, 1, 0))
+
+				// time moving on ages links out of the short windows
+				db.PopulateTopDomains(ctx, now.Add(2*time.Hour))
+				assert.Empty(t, db.RetrieveTopDomains(ctx, 10, time.Hour))
+			})
+			t.Run("TopDomainWindowEdges", func(t *testing.T) {
+				db := newDB(t)
+				ctx := context.Background()
+				// mid-hour, so that the windows start half way through an hour
+				now := time.Date(2025, 3, 1, 10, 30, 0, 0, time.UTC)
+				for i, age := range []time.Duration{
+					10 * time.Minute, 59 * time.Minute, // within the hour
+					70 * time.Minute, 23*time.Hour + 50*time.Minute, // within the day
+					24*time.Hour + 10*time.Minute, // same hour as the start of the day window
+				} {
+					data := sampleData(fmt.Sprintf("E%d", i), fmt.Sprintf("https://edge.com/%d", i), "edge.com")
+					data.CreatedAt = now.Add(-age)
+					require.NoError(t, db.AddData(ctx, data.ShortURl, data))
+				}
+				db.PopulateTopDomains(ctx, now)
+				assert.Equal(t, []entities.TopDomains{{Domain: "edge.com", Count: 2}}, db.RetrieveTopDomains(ctx, 10, time.Hour))
+				assert.Equal(t, []entities.TopDomains{{Domain: "edge.com", Count: 4}}, db.RetrieveTopDomains(ctx, 10, 24*time.Hour))
+				assert.Equal(t, []entities.TopDomains{{Domain: "edge.com", Count: 5}}, db.RetrieveTopDomains(ctx, 10, 7*24*time.Hour))
+			})
+			t.Run("PurgeExpired", func(t *testing.T) {
+				db := newDB(t)
+				ctx := context.Background()
+				now := time.Now()
+				expired := sampleData("OLD1", "https://a.com/old", "a.com")
+				expired.ExpiryDate = now.Add(-time.Minute)
+				live := sampleData("NEW1", "https://a.com/new", "a.com")
+				never := sampleData("FOREVER", "https://b.com/forever", "b.com")
+				never.ExpiryDate = time.Time{}
+				for _, data := range []entities.ShortURLDBData{expired, live, never} {
+					require.NoError(t, db.AddData(ctx, data.ShortURl, data))
+				}
+
+				assert.Equal(t, 1, db.PurgeExpired(ctx, now))
+				assert.Nil(t, db.RetrieveData(ctx, "OLD1"))
+				assert.Equal(t, "", db.RetrieveDuplicateURL(ctx, expired.LongURL))
+				assert.NoError(t, db.CheckDuplicateRequest(ctx, "OLD1"))
+				assert.NotNil(t, db.RetrieveData(ctx, "NEW1"))
+				assert.NotNil(t, db.RetrieveData(ctx, "FOREVER"))
+				db.PopulateTopDomains(ctx, time.Now())
+				assert.ElementsMatch(t, []entities.TopDomains{{Domain: "a.com", Count: 1}, {Domain: "b.com", Count: 1}}, db.RetrieveTopDomains(ctx, 3, 0))
+
+				assert.Equal(t, 0, db.PurgeExpired(ctx, now))
+				assert.Equal(t, 1, db.PurgeExpired(ctx, now.AddDate(0, 1, 0)))
+				db.PopulateTopDomains(ctx, time.Now())
+				assert.Equal(t, []entities.TopDomains{{Domain: "b.com", Count: 1}}, db.RetrieveTopDomains(ctx, 3, 0))
+			})
+			t.Run("Clicks", func(t *testing.T) {
+				db := newDB(t)
+				ctx := context.Background()
+				require.NoError(t, db.AddData(ctx, "A1", sampleData("A1", "https://a.com/1", "a.com")))
+				assert.Nil(t, db.RetrieveClickStats(ctx, "A1"))
+
+				day1 := time.Date(2025, 3, 1, 10, 0, 0, 0, time.UTC)
+				day2 := day1.AddDate(0, 0, 1)
+				require.NoError(t, db.RecordClicks(ctx, []entities.Click{
+					{Code: "A1", Time: day1, Referrer: "news.ycombinator.com", Device: "desktop", Browser: "Firefox"},
+					{Code: "A1", Time: day1, Device: "mobile", Browser: "Safari"},
+					{Code: "A1", Time: day2, Referrer: "news.ycombinator.com", Device: "desktop", Browser: "Chrome"},
+					{Code: "GONE", Time: day2},
+				}))
+				stats := db.RetrieveClickStats(ctx, "A1")
+				require.NotNil(t, stats)
+				assert.Equal(t, 3, stats.Total)
+				assert.Equal(t, map[string]int{"2025-03-01": 2, "2025-03-02": 1}, stats.Daily)
+				assert.Equal(t, map[string]int{"news.ycombinator.com": 2, "": 1}, stats.Referrers)
+				assert.Equal(t, map[string]int{"desktop": 2, "mobile": 1}, stats.Devices)
+				assert.Nil(t, db.RetrieveClickStats(ctx, "GONE"))
+
+				// returned stats are a snapshot
+				stats.Daily["2025-03-01"] = 100
+				assert.Equal(t, 2, db.RetrieveClickStats(ctx, "A1").Daily["2025-03-01"])
+			})
+			t.Run("Namespaces", func(t *testing.T) {
+				db := newDB(t)
+				ctx := context.Background()
+				onB := NamespacedKey("b.co", "A1")
+				require.NoError(t, db.AddData(ctx, "A1", sampleData("A1", "https://a.com/1", "a.com")))
+				require.NoError(t, db.AddData(ctx, onB, sampleData("A1", "https://a.com/1", "a.com")))
+				assert.Error(t, db.CheckDuplicateRequest(ctx, onB))
+				assert.NoError(t, db.CheckDuplicateRequest(ctx, NamespacedKey("c.co", "A1")))
+				assert.Equal(t, "A1", db.RetrieveDuplicateURL(ctx, "https://a.com/1"))
+				assert.Equal(t, onB, db.RetrieveDuplicateURL(ctx, NamespacedKey("b.co", "https://a.com/1")))
+
+				require.NoError(t, db.DeleteData(ctx, onB))
+				assert.Equal(t, "", db.RetrieveDuplicateURL(ctx, NamespacedKey("b.co", "https://a.com/1")))
+				assert.Equal(t, "A1", db.RetrieveDuplicateURL(ctx, "https://a.com/1"))
+				assert.NoError(t, db.CheckDuplicateRequest(ctx, onB))
+				assert.Error(t, db.CheckDuplicateRequest(ctx, "A1"))
+			})
+			t.Run("Owners", func(t *testing.T) {
+				db := newDB(t)
+				ctx := context.Background()
+				alice := sampleData("A1", "https://a.com/1", "a.com")
+				alice.Owner = "alice"
+				require.NoError(t, db.AddData(ctx, "A1", alice))
+				bob := sampleData("B1", "https://a.com/1", "a.com")
+				bob.Owner = "bob"
+				link, created, err := db.GetOrCreate(ctx, "B1", bob)
+				require.NoError(t, err)
+				assert.True(t, created, "another owner gets a link of its own")
+				assert.Equal(t, "B1", link.ShortURl)
+				assert.Equal(t, "A1", db.RetrieveDuplicateURL(ctx, OwnedURL("alice", "https://a.com/1")))
+				assert.Equal(t, "B1", db.RetrieveDuplicateURL(ctx, OwnedURL("bob", "https://a.com/1")))
+				assert.Equal(t, "", db.RetrieveDuplicateURL(ctx, "https://a.com/1"))
+
+				retargeted := alice
+				retargeted.LongURL = "https://a.com/2"
+				require.NoError(t, db.UpdateData(ctx, "A1", retargeted))
+				assert.Equal(t, "", db.RetrieveDuplicateURL(ctx, OwnedURL("alice", "https://a.com/1")))
+				assert.Equal(t, "A1", db.RetrieveDuplicateURL(ctx, OwnedURL("alice", "https://a.com/2")))
+				assert.Equal(t, "B1", db.RetrieveDuplicateURL(ctx, OwnedURL("bob", "https://a.com/1")))
+			})
+			t.Run("UpdateData", func(t *testing.T) {
+				db := newDB(t)
+				ctx := context.Background()
+				original := sampleData("A1", "https://a.com/1", "a.com")
+				require.NoError(t, db.AddData(ctx, "A1", original))
+				require.NoError(t, db.AddData(ctx, "B1", sampleData("B1", "https://b.com/1", "b.com")))
+
+				updated := sampleData("A1", "https://c.com/1", "c.com")
+				updated.CreatedAt = time.Time{} // creation time cannot change
+				updated.Disabled = true
+				require.NoError(t, db.UpdateData(ctx, "A1", updated))
+				got := db.RetrieveData(ctx, "A1")
+				require.NotNil(t, got)
+				assert.Equal(t, "https://c.com/1", got.LongURL)
+				assert.True(t, got.Disabled)
+				assert.True(t, original.CreatedAt.Equal(got.CreatedAt))
+				assert.Equal(t, "", db.RetrieveDuplicateURL(ctx, "https://a.com/1"))
+				assert.Equal(t, "A1", db.RetrieveDuplicateURL(ctx, "https://c.com/1"))
+				db.PopulateTopDomains(ctx, time.Now())
+				assert.Equal(t, []entities.TopDomains{{Domain: "b.com", Count: 1}, {Domain: "c.com", Count: 1}}, db.RetrieveTopDomains(ctx, 10, 0))
+
+				// retargeting onto another link's URL leaves that link's duplicate entry alone
+				require.NoError(t, db.UpdateData(ctx, "A1", sampleData("A1", "https://b.com/1", "b.com")))
+				assert.Equal(t, "B1", db.RetrieveDuplicateURL(ctx, "https://b.com/1"))
+				assert.Equal(t, "", db.RetrieveDuplicateURL(ctx, "https://c.com/1"))
+
+				assert.ErrorIs(t, db.UpdateData(ctx, "NOPE", updated), ErrKeyNotFound)
+				assert.Equal(t, 2, db.CountLinks(ctx))
+			})
+			t.Run("GetOrCreate", func(t *testing.T) {
+				db := newDB(t)
+				ctx := context.Background()
+				first := sampleData("A1", "https://a.com/1", "a.com")
+				link, created, err := db.GetOrCreate(ctx, "A1", first)
+				require.NoError(t, err)
+				assert.True(t, created)
+				assert.Equal(t, "A1", link.ShortURl)
+
+				// the same URL under another code returns the live link
+				link, created, err = db.GetOrCreate(ctx, "B2", sampleData("B2", "https://a.com/1", "a.com"))
+				require.NoError(t, err)
+				assert.False(t, created)
+				assert.Equal(t, "A1", link.ShortURl)
+				assert.Nil(t, db.RetrieveData(ctx, "B2"))
+
+				_, _, err = db.GetOrCreate(ctx, "A1", sampleData("A1", "https://b.com/1", "b.com"))
+				assert.ErrorIs(t, err, ErrURLAlreadyShortened)
+
+				// other namespaces have their own links
+				_, created, err = db.GetOrCreate(ctx, NamespacedKey("b.co", "A1"), first)
+				require.NoError(t, err)
+				assert.True(t, created)
+
+				// a link expired at the new link's creation is replaced
+				later := sampleData("C3", "https://a.com/1", "a.com")
+				later.CreatedAt = first.ExpiryDate.Add(time.Second)
+				link, created, err = db.GetOrCreate(ctx, "C3", later)
+				require.NoError(t, err)
+				assert.True(t, created)
+				assert.Equal(t, "C3", db.RetrieveDuplicateURL(ctx, "https://a.com/1"))
+
+				disabled := db.RetrieveData(ctx, "C3")
+				disabled.Disabled = true
+				require.NoError(t, db.UpdateData(ctx, "C3", *disabled))
+				_, created, err = db.GetOrCreate(ctx, "D4", sampleData("D4", "https://a.com/1", "a.com"))
+				require.NoError(t, err)
+				assert.True(t, created, "a disabled link is not reused")
+				assert.Equal(t, 4, db.CountLinks(ctx))
+			})
+			t.Run("GetOrCreateConcurrent", func(t *testing.T) {
+				db := newDB(t)
+				ctx := context.Background()
+				const creators, urls = 32, 10
+				var wg sync.WaitGroup
+				var createdCount atomic.Int32
+				codes := make([][]string, creators)
+				for c := 0; c < creators; c++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						for i := 0; i < urls; i++ {
+							// every creator proposes its own code for the shared URLs
+							code := fmt.Sprintf("C%dU%d", c, i)
+							link, created, err := db.GetOrCreate(ctx, code, sampleData(code, fmt.Sprintf("https://a.com/%d", i), "a.com"))
+							if !assert.NoError(t, err) {
+								return
+							}
+							if created {
+								createdCount.Add(1)
+							}
+							codes[c] = append(codes[c], link.ShortURl)
+						}
+					}()
+				}
+				wg.Wait()
+				assert.Equal(t, int32(urls), createdCount.Load())
+				assert.Equal(t, urls, db.CountLinks(ctx))
+				for c := 1; c < creators; c++ {
+					assert.Equal(t, codes[0], codes[c], "every creator sees the same link per URL")
+				}
+			})
+			t.Run("DeleteData", func(t *testing.T) {
+				db := newDB(t)
+				ctx := context.Background()
+				require.NoError(t, db.AddData(ctx, "A1", sampleData("A1", "https://a.com/1", "a.com")))
+				require.NoError(t, db.AddData(ctx, "A2", sampleData("A2", "https://a.com/2", "a.com")))
+				require.NoError(t, db.RecordClicks(ctx, []entities.Click{{Code: "A1", Time: time.Now()}}))
+
+				require.NoError(t, db.DeleteData(ctx, "A1"))
+				assert.Nil(t, db.RetrieveData(ctx, "A1"))
+				assert.Nil(t, db.RetrieveClickStats(ctx, "A1"))
+				assert.Equal(t, "", db.RetrieveDuplicateURL(ctx, "https://a.com/1"))
+				assert.NoError(t, db.CheckDuplicateRequest(ctx, "A1"), "a deleted code can be reused")
+				db.PopulateTopDomains(ctx, time.Now())
+				assert.Equal(t, []entities.TopDomains{{Domain: "a.com", Count: 1}}, db.RetrieveTopDomains(ctx, 10, 0))
+				assert.ErrorIs(t, db.DeleteData(ctx, "A1"), ErrKeyNotFound)
+				require.NoError(t, db.AddData(ctx, "A1", sampleData("A1", "https://a.com/3", "a.com")))
+			})
+
+			t.Run("ReserveSequence", func(t *testing.T) {
+				db := newDB(t)
+				ctx := context.Background()
+				start, err := db.ReserveSequence(ctx, 100)
+				require.NoError(t, err)
+				assert.Zero(t, start)
+				require.NoError(t, db.AddData(ctx, "000001", sampleData("000001", "https://a.com/1", "a.com")))
+				require.NoError(t, db.DeleteData(ctx, "000001"))
+				start, err = db.ReserveSequence(ctx, 10)
+				require.NoError(t, err)
+				assert.Equal(t, uint64(100), start, "deleting links does not rewind the sequence")
+				start, err = db.ReserveSequence(ctx, 10)
+				require.NoError(t, err)
+				assert.Equal(t, uint64(110), start)
+			})
+		})
+	}
+}
+
+// Test that Open knows every backend, and the conformance suite covers them all
+func TestOpen(t *testing.T) {
+	for _, store := range Stores {
+		assert.Contains(t, backends, store)
+		db, err := Open(store, filepath.Join(t.TempDir(), "urls.db"))
+		require.NoError(t, err, store)
+		assert.Zero(t, db.CountLinks(context.Background()))
+		if closer, ok := db.(io.Closer); ok {
+			assert.NoError(t, closer.Close())
+		}
+	}
+	_, err := Open("redis", "")
+	assert.ErrorContains(t, err, `unknown storage backend "redis"`)
+}
+
+// Test that the file backend serves previously written links after a restart
+func TestFileDatabase_SurvivesReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "urls.db")
+	ctx := context.Background()
+	db, err := NewFileDatabase(path)
+	require.NoError(t, err)
+	data := sampleData("ABC123", "https://www.reddit.com/r/Fedora/", "www.reddit.com")
+	require.NoError(t, db.AddData(ctx, "ABC123", data))
+	require.NoError(t, db.AddData(ctx, "DEF456", sampleData("DEF456", "https://www.reddit.com/r/golang/", "www.reddit.com")))
+	require.NoError(t, db.Close())
+
+	reopened, err := NewFileDatabase(path)
+	require.NoError(t, err)
+	defer reopened.Close()
+	got := reopened.RetrieveData(ctx, "ABC123")
+	require.NotNil(t, got)
+	assert.Equal(t, data.LongURL, got.LongURL)
+	assert.True(t, data.ExpiryDate.Equal(got.ExpiryDate))
+	assert.Equal(t, "DEF456", reopened.RetrieveDuplicateURL(ctx, "https://www.reddit.com/r/golang/"))
+	assert.Error(t, reopened.CheckDuplicateRequest(ctx, "ABC123"))
+	reopened.PopulateTopDomains(ctx, time.Now())
+	assert.Equal(t, []entities.TopDomains{{Domain: "www.reddit.com", Count: 2}}, reopened.RetrieveTopDomains(ctx, 3, 0))
+}
+
+// Test that purged links stay gone after a restart
+func TestFileDatabase_PurgeSurvivesReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "urls.db")
+	ctx := context.Background()
+	db, err := NewFileDatabase(path)
+	require.NoError(t, err)
+	expired := sampleData("OLD1", "https://a.com/old", "a.com")
+	expired.ExpiryDate = time.Now().Add(-time.Minute)
+	require.NoError(t, db.AddData(ctx, "OLD1", expired))
+	require.NoError(t, db.AddData(ctx, "NEW1", sampleData("NEW1", "https://a.com/new", "a.com")))
+	assert.Equal(t, 1, db.PurgeExpired(ctx, time.Now()))
+	require.NoError(t, db.Close())
+
+	reopened, err := NewFileDatabase(path)
+	require.NoError(t, err)
+	defer reopened.Close()
+	assert.Nil(t, reopened.RetrieveData(ctx, "OLD1"))
+	assert.NotNil(t, reopened.RetrieveData(ctx, "NEW1"))
+	reopened.PopulateTopDomains(ctx, time.Now())
+	assert.Equal(t, []entities.TopDomains{{Domain: "a.com", Count: 1}}, reopened.RetrieveTopDomains(ctx, 3, 0))
+}
+
+// Test that recorded clicks are replayed after a restart
+func TestFileDatabase_ClicksSurviveReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "urls.db")
+	ctx := context.Background()
+	db, err := NewFileDatabase(path)
+	require.NoError(t, err)
+	require.NoError(t, db.AddData(ctx, "A1", sampleData("A1", "https://a.com/1", "a.com")))
+	require.NoError(t, db.RecordClicks(ctx, []entities.Click{
+		{Code: "A1", Time: time.Now(), Device: "desktop", Browser: "Chrome"},
+		{Code: "A1", Time: time.Now(), Device: "bot", Browser: "other"},
+	}))
+	require.NoError(t, db.Close())
+
+	reopened, err := NewFileDatabase(path)
+	require.NoError(t, err)
+	defer reopened.Close()
+	stats := reopened.RetrieveClickStats(ctx, "A1")
+	require.NotNil(t, stats)
+	assert.Equal(t, 2, stats.Total)
+	assert.Equal(t, map[string]int{"desktop": 1, "bot": 1}, stats.Devices)
+}
+
+// Test that updates and deletions are replayed after a restart
+func TestFileDatabase_UpdateAndDeleteSurviveReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "urls.db")
+	ctx := context.Background()
+	db, err := NewFileDatabase(path)
+	require.NoError(t, err)
+	require.NoError(t, db.AddData(ctx, "A1", sampleData("A1", "https://a.com/1", "a.com")))
+	require.NoError(t, db.AddData(ctx, "B1", sampleData("B1", "https://b.com/1", "b.com")))
+	require.NoError(t, db.UpdateData(ctx, "A1", sampleData("A1", "https://c.com/1", "c.com")))
+	require.NoError(t, db.DeleteData(ctx, "B1"))
+	require.NoError(t, db.Close())
+
+	reopened, err := NewFileDatabase(path)
+	require.NoError(t, err)
+	defer reopened.Close()
+	assert.Equal(t, "https://c.com/1", reopened.RetrieveData(ctx, "A1").LongURL)
+	assert.Nil(t, reopened.RetrieveData(ctx, "B1"))
+	reopened.PopulateTopDomains(ctx, time.Now())
+	assert.Equal(t, []entities.TopDomains{{Domain: "c.com", Count: 1}}, reopened.RetrieveTopDomains(ctx, 10, 0))
+}
+
+// Test that a record torn by a crash during append is dropped on open, while
+// corruption before the last record still fails it
+func TestFileDatabase_TornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "urls.db")
+	ctx := context.Background()
+	db, err := NewFileDatabase(path)
+	require.NoError(t, err)
+	require.NoError(t, db.AddData(ctx, "A1", sampleData("A1", "https://a.com/1", "a.com")))
+	require.NoError(t, db.Close())
+	whole, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	for name, tail := range map[string]string{
+		"partial record":      `{"op":"add","key":"B1","data":{"Lon`,
+		"unterminated record": `{"op":"delete","key":"A1"}`,
+		"garbage line":        "\x00\x00\x00\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			require.NoError(t, os.WriteFile(path, append(append([]byte{}, whole...), tail...), 0o644))
+			reopened, err := NewFileDatabase(path)
+			require.NoError(t, err)
+			assert.NotNil(t, reopened.RetrieveData(ctx, "A1"))
+			assert.Nil(t, reopened.RetrieveData(ctx, "B1"))
+
+			// the store keeps appending after the last whole record
+			require.NoError(t, reopened.AddData(ctx, "C1", sampleData("C1", "https://c.com/1", "c.com")))
+			require.NoError(t, reopened.Close())
+			reopened, err = NewFileDatabase(path)
+			require.NoError(t, err)
+			defer reopened.Close()
+			assert.NotNil(t, reopened.RetrieveData(ctx, "A1"))
+			assert.NotNil(t, reopened.RetrieveData(ctx, "C1"))
+		})
+	}
+
+	t.Run("corrupt middle record", func(t *testing.T) {
+		corrupt := append([]byte(`{"op":"add","key":"B1"`+"\n"), whole...)
+		require.NoError(t, os.WriteFile(path, corrupt, 0o644))
+		_, err := NewFileDatabase(path)
+		assert.ErrorContains(t, err, "line 1")
+	})
+}
+
+// Test that compaction shrinks the journal to one record per link without
+// changing what a reopened store serves
+func TestFileDatabase_Compaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "urls.db")
+	ctx := context.Background()
+	db, err := NewFileDatabase(path)
+	require.NoError(t, err)
+	db.compactAfter = 10
+	now := time.Now()
+	expired := sampleData("OLD1", "https://a.com/old", "a.com")
+	expired.ExpiryDate = now.Add(-time.Minute)
+	require.NoError(t, db.AddData(ctx, "OLD1", expired))
+	require.NoError(t, db.AddData(ctx, "A1", sampleData("A1", "https://a.com/1", "a.com")))
+	require.NoError(t, db.AddData(ctx, "A2", sampleData("A2", "https://b.com/1", "b.com")))
+	// A2 moves onto the URL of A1, which keeps the duplicate entry
+	require.NoError(t, db.UpdateData(ctx, "A2", sampleData("A2", "https://a.com/1", "a.com")))
+	require.NoError(t, db.AddData(ctx, "B1", sampleData("B1", "https://b.com/2", "b.com")))
+	require.NoError(t, db.DeleteData(ctx, "B1"))
+	for i := 0; i < 20; i++ {
+		require.NoError(t, db.RecordClicks(ctx, []entities.Click{{Code: "A1", Time: now, Device: "desktop"}}))
+	}
+	_, err = db.ReserveSequence(ctx, 100)
+	require.NoError(t, err)
+
+	assert.Equal(t, 1, db.PurgeExpired(ctx, now))
+	journal, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, 3, strings.Count(string(journal), "\n"), "one record per link and the sequence")
+	require.NoError(t, db.AddData(ctx, "C1", sampleData("C1", "https://c.com/1", "c.com")))
+	require.NoError(t, db.Close())
+
+	reopened, err := NewFileDatabase(path)
+	require.NoError(t, err)
+	defer reopened.Close()
+	assert.Equal(t, 3, reopened.CountLinks(ctx))
+	assert.Nil(t, reopened.RetrieveData(ctx, "OLD1"))
+	assert.Nil(t, reopened.RetrieveData(ctx, "B1"))
+	assert.Equal(t, "A1", reopened.RetrieveDuplicateURL(ctx, "https://a.com/1"))
+	assert.Equal(t, "", reopened.RetrieveDuplicateURL(ctx, "https://b.com/1"))
+	assert.Equal(t, "C1", reopened.RetrieveDuplicateURL(ctx, "https://c.com/1"))
+	stats := reopened.RetrieveClickStats(ctx, "A1")
+	require.NotNil(t, stats)
+	assert.Equal(t, 20, stats.Total)
+	assert.Equal(t, map[string]int{"desktop": 20}, stats.Devices)
+	reopened.PopulateTopDomains(ctx, time.Now())
+	assert.Equal(t, []entities.TopDomains{{Domain: "a.com", Count: 2}, {Domain: "c.com", Count: 1}}, reopened.RetrieveTopDomains(ctx, 10, 0))
+	start, err := reopened.ReserveSequence(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(100), start, "the sequence survives compaction")
+}
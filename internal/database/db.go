@@ -3,62 +3,233 @@ package database
 import (
 	"context"
 	"errors"
-	"sort"
+	"strings"
 	"sync"
+	"time"
 	"urlshortener/internal/entities"
 )
 
 type InMemoryDatabase struct {
-	shortUrlDB  map[string]entities.ShortURLDBData // Retrieval DB
-	metricsDB   sync.Map                           // Retrieval DB
-	longUrlDB   map[string]string                  // Duplicate Request DB
-	repeatUrlDB map[string]bool                    // collision db
-	topDomains  *[]entities.TopDomains
+	shortUrlDB  map[string]entities.ShortURLDBData      // Retrieval DB
+	metricsDB   *domainCounters                         // Retrieval DB
+	longUrlDB   map[string]string                       // Duplicate Request DB
+	repeatUrlDB map[string]bool                         // collision db
+	clicksDB    map[string]*entities.ClickStats         // analytics db
+	topDomains  map[time.Duration][]entities.TopDomains // ranking snapshot per window
+	sequence    uint64                                  // next unreserved number of the code sequence
 	mu          sync.RWMutex
 }
 
+// ErrURLAlreadyShortened is returned by AddData when the short code is taken.
+var ErrURLAlreadyShortened = errors.New("URL is already shortened")
+
+// ErrKeyNotFound is returned by UpdateData and DeleteData for unknown short codes.
+var ErrKeyNotFound = errors.New("short code not found")
+
 func NewInMemoryDatabase() *InMemoryDatabase {
 	shortUrlDB := make(map[string]entities.ShortURLDBData)
 	repeatUrlDB := make(map[string]bool)
 	longUrlDB := make(map[string]string)
-	topDomains := make([]entities.TopDomains, 3)
 	return &InMemoryDatabase{
 		shortUrlDB:  shortUrlDB,
 		repeatUrlDB: repeatUrlDB,
 		longUrlDB:   longUrlDB,
-		topDomains:  &topDomains,
+		clicksDB:    make(map[string]*entities.ClickStats),
+		metricsDB:   newDomainCounters(),
+		topDomains:  make(map[time.Duration][]entities.TopDomains),
+	}
+}
+
+// NamespacedKey scopes key (a short code or a long URL) to the short domain
+// namespace, so that every short domain has its own codes and duplicate
+// index. The empty namespace, used by the default domain, leaves key as is.
+func NamespacedKey(namespace, key string) string {
+	if namespace == "" {
+		return key
+	}
+	return namespace + "/" + key
+}
+
+// OwnedURL scopes longURL to the API key that owns its links, so that two
+// keys never share a link, and one cannot retarget the links the other hands
+// out. Links without an owner share the bare URL. Canonical URLs start with
+// their scheme and never contain a space.
+func OwnedURL(owner, longURL string) string {
+	if owner == "" {
+		return longURL
+	}
+	return owner + " " + longURL
+}
+
+// dedupKey returns the duplicate index entry of longURL owned by owner and
+// stored under key, in the namespace of key. Codes never contain "/".
+func dedupKey(key, owner, longURL string) string {
+	namespace, _, found := strings.Cut(key, "/")
+	if !found {
+		return OwnedURL(owner, longURL)
 	}
+	return NamespacedKey(namespace, OwnedURL(owner, longURL))
 }
 
+// DB stores links by key. Keys of links on the default short domain are their
+// code; other short domains use NamespacedKey(host, code), and look up
+// duplicates with NamespacedKey(host, OwnedURL(owner, longURL)).
 type DB interface {
 	AddData(ctx context.Context, key string, data entities.ShortURLDBData) error
+	// GetOrCreate atomically returns the live link already stored for
+	// data.LongURL in the namespace of key, or stores data under key. created
+	// reports which happened; a link expired at data.CreatedAt or disabled is
+	// not live. It fails with ErrURLAlreadyShortened when key is taken.
+	GetOrCreate(ctx context.Context, key string, data entities.ShortURLDBData) (link *entities.ShortURLDBData, created bool, err error)
 	CheckDuplicateRequest(ctx context.Context, key string) error
 	RetrieveData(ctx context.Context, data string) *entities.ShortURLDBData
 	RetrieveDuplicateURL(ctx context.Context, data string) string
-	RetrieveTop3Domain(ctx context.Context) []entities.TopDomains
-	PopulateTop3Domain(ctx context.Context)
+	// UpdateData replaces the stored link of key, keeping the duplicate URL
+	// index and domain counters in step. The short code itself cannot change.
+	UpdateData(ctx context.Context, key string, data entities.ShortURLDBData) error
+	// DeleteData removes key from every index, its clicks included.
+	DeleteData(ctx context.Context, key string) error
+	// RetrieveTopDomains returns the top limit domains by links created within
+	// window (one of TopDomainWindows, zero for all time) as of the last PopulateTopDomains.
+	RetrieveTopDomains(ctx context.Context, limit int, window time.Duration) []entities.TopDomains
+	PopulateTopDomains(ctx context.Context, now time.Time)
+	// PurgeExpired removes every link that has expired at now from all indexes
+	// and returns how many were removed.
+	PurgeExpired(ctx context.Context, now time.Time) int
+	// CountLinks returns the number of stored links, expired ones included.
+	CountLinks(ctx context.Context) int
+	RecordClicks(ctx context.Context, clicks []entities.Click) error
+	RetrieveClickStats(ctx context.Context, key string) *entities.ClickStats
+	// ReserveSequence reserves the next n numbers of the code sequence and
+	// returns the first. Reserved numbers are never returned again, whatever
+	// happens to the links stored under them.
+	ReserveSequence(ctx context.Context, n uint64) (uint64, error)
 }
 
 func (db *InMemoryDatabase) AddData(ctx context.Context, key string, data entities.ShortURLDBData) error {
 	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.shortUrlDB[key]; ok {
+		return ErrURLAlreadyShortened
+	}
+	db.addLocked(key, data)
+	return nil
+}
+
+func (db *InMemoryDatabase) GetOrCreate(ctx context.Context, key string, data entities.ShortURLDBData) (*entities.ShortURLDBData, bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if existing := db.liveDuplicateLocked(key, data); existing != nil {
+		return existing, false, nil
+	}
 	if _, ok := db.shortUrlDB[key]; ok {
-		return errors.New("URL is already shortened")
+		return nil, false, ErrURLAlreadyShortened
 	}
+	db.addLocked(key, data)
+	return &data, true, nil
+}
+
+// addLocked indexes a new link. The caller must hold db.mu for writing.
+func (db *InMemoryDatabase) addLocked(key string, data entities.ShortURLDBData) {
 	db.shortUrlDB[key] = data
-	db.longUrlDB[data.LongURL] = key
-	value, ok := db.metricsDB.Load(data.LongURLDomain)
+	db.longUrlDB[dedupKey(key, data.Owner, data.LongURL)] = key
+	db.metricsDB.add(data.LongURLDomain, data.CreatedAt)
+	db.repeatUrlDB[key] = true
+}
+
+// liveDuplicateLocked returns the link already indexed for data.LongURL in
+// the namespace of key, unless it is expired at data.CreatedAt or disabled.
+// The caller must hold db.mu.
+func (db *InMemoryDatabase) liveDuplicateLocked(key string, data entities.ShortURLDBData) *entities.ShortURLDBData {
+	existingKey, ok := db.longUrlDB[dedupKey(key, data.Owner, data.LongURL)]
+	if !ok {
+		return nil
+	}
+	existing, ok := db.shortUrlDB[existingKey]
+	if !ok || existing.Expired(data.CreatedAt) || existing.Disabled {
+		return nil
+	}
+	return &existing
+}
+
+func (db *InMemoryDatabase) UpdateData(ctx context.Context, key string, data entities.ShortURLDBData) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.updateLocked(key, data)
+}
+
+// updateLocked replaces the link of key. The caller must hold db.mu for writing.
+func (db *InMemoryDatabase) updateLocked(key string, data entities.ShortURLDBData) error {
+	old, ok := db.shortUrlDB[key]
 	if !ok {
-		db.metricsDB.Store(data.LongURLDomain, 1)
-	} else {
-		valueRead := value.(int) + 1
-		db.metricsDB.Store(data.LongURLDomain, valueRead)
+		return ErrKeyNotFound
+	}
+	data.ShortURl = old.ShortURl
+	data.CreatedAt = old.CreatedAt
+	db.shortUrlDB[key] = data
+	if oldKey, newKey := dedupKey(key, old.Owner, old.LongURL), dedupKey(key, data.Owner, data.LongURL); oldKey != newKey {
+		if db.longUrlDB[oldKey] == key {
+			delete(db.longUrlDB, oldKey)
+		}
+		// never steal the duplicate entry of another link
+		if db.longUrlDB[newKey] == "" {
+			db.longUrlDB[newKey] = key
+		}
+	}
+	if old.LongURLDomain != data.LongURLDomain {
+		db.metricsDB.remove(old.LongURLDomain, old.CreatedAt)
+		db.metricsDB.add(data.LongURLDomain, data.CreatedAt)
 	}
-	db.repeatUrlDB[data.ShortURl] = true
-	db.mu.Unlock()
 	return nil
 }
 
+func (db *InMemoryDatabase) DeleteData(ctx context.Context, key string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.shortUrlDB[key]; !ok {
+		return ErrKeyNotFound
+	}
+	db.deleteLocked(key)
+	return nil
+}
+
+func (db *InMemoryDatabase) PurgeExpired(ctx context.Context, now time.Time) int {
+	return len(db.purgeExpired(now))
+}
+
+// purgeExpired removes expired links and returns their keys.
+func (db *InMemoryDatabase) purgeExpired(now time.Time) []string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var removed []string
+	for key, data := range db.shortUrlDB {
+		if data.Expired(now) {
+			db.deleteLocked(key)
+			removed = append(removed, key)
+		}
+	}
+	return removed
+}
+
+// deleteLocked drops key from every index and decrements its domain counter.
+// The caller must hold db.mu for writing.
+func (db *InMemoryDatabase) deleteLocked(key string) {
+	data, ok := db.shortUrlDB[key]
+	if !ok {
+		return
+	}
+	delete(db.shortUrlDB, key)
+	delete(db.clicksDB, key)
+	if longKey := dedupKey(key, data.Owner, data.LongURL); db.longUrlDB[longKey] == key {
+		delete(db.longUrlDB, longKey)
+	}
+	delete(db.repeatUrlDB, key)
+	db.metricsDB.remove(data.LongURLDomain, data.CreatedAt)
+}
+
 func (db *InMemoryDatabase) CheckDuplicateRequest(ctx context.Context, key string) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
 	if _, ok := db.repeatUrlDB[key]; ok {
 		err := errors.New("Duplicate Request")
 		return err
@@ -75,40 +246,25 @@ func (db *InMemoryDatabase) RetrieveData(ctx context.Context, data string) *enti
 	return nil
 }
 
-func (db *InMemoryDatabase) RetrieveDuplicateURL(ctx context.Context, data string) string {
+func (db *InMemoryDatabase) CountLinks(ctx context.Context) int {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
-	if result, ok := db.longUrlDB[data]; ok {
-		return result
-	}
-	return ""
+	return len(db.shortUrlDB)
 }
 
-func (db *InMemoryDatabase) PopulateTop3Domain(ctx context.Context) {
-	var domains []entities.TopDomains
-	db.metricsDB.Range(func(key, value any) bool {
-		if count, ok := value.(int); ok {
-			domains = append(domains, entities.TopDomains{key.(string), count})
-		}
-		return true
-	})
-	sort.Slice(domains, func(i, j int) bool {
-		return domains[i].Count > domains[j].Count
-	})
+func (db *InMemoryDatabase) ReserveSequence(ctx context.Context, n uint64) (uint64, error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	topDomains := make([]entities.TopDomains, 0)
-	for i := 0; i < len(domains) && i < 3; i++ {
-		topDomains = append(topDomains, entities.TopDomains{
-			Domain: domains[i].Domain,
-			Count:  domains[i].Count,
-		})
-	}
-	db.topDomains = &topDomains
+	start := db.sequence
+	db.sequence += n
+	return start, nil
 }
 
-func (db *InMemoryDatabase) RetrieveTop3Domain(ctx context.Context) []entities.TopDomains {
+func (db *InMemoryDatabase) RetrieveDuplicateURL(ctx context.Context, data string) string {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
-	return append([]entities.TopDomains{}, *db.topDomains...)
+	if result, ok := db.longUrlDB[data]; ok {
+		return result
+	}
+	return ""
 }
@@ -4,6 +4,7 @@ import (
 	"context"
 	"github.com/stretchr/testify/assert"
 	"testing"
+	"time"
 	"urlshortener/internal/entities"
 )
 
@@ -17,15 +18,10 @@ func TestInMemoryDatabase_AddData(t *testing.T) {
 	app.AddData(ctx, "https://longURL.com/test", data)
 	assert.Len(t, app.longUrlDB, 1)
 	assert.Len(t, app.repeatUrlDB, 1)
-	count := 0
-	app.metricsDB.Range(func(key, value interface{}) bool {
-		count++
-		return true
-	})
-	assert.Equal(t, count, 1)
-	countOfArr := len(*app.topDomains)
-	app.PopulateTop3Domain(ctx)
-	assert.Equal(t, countOfArr, 3)
+	assert.Equal(t, app.metricsDB.len(), 1)
+	assert.Len(t, app.RetrieveTopDomains(ctx, 3, 0), 0)
+	app.PopulateTopDomains(ctx, time.Now())
+	assert.Len(t, app.RetrieveTopDomains(ctx, 3, 0), 1)
 }
 
 func TestInMemoryDatabase_CheckDuplicateRequest(t *testing.T) {
@@ -0,0 +1,378 @@
+package database
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"urlshortener/internal/entities"
+)
+
+// FileDatabase is a durable DB backend. Every mutation is appended to a
+// journal file (one JSON record per line) and fsynced before it is
+// acknowledged; on open the journal is replayed into an in-memory index,
+// so reads are served exactly like InMemoryDatabase.
+//
+// Once the journal holds more than twice as many records as there are links,
+// it is compacted on open and after purges: a snapshot of the live links and
+// their click aggregates replaces it, so neither the file nor the replay on
+// startup grows with the history of the store.
+type FileDatabase struct {
+	*InMemoryDatabase
+	file         *os.File
+	path         string
+	records      int        // records in the journal
+	compactAfter int        // smallest journal that is worth compacting
+	mu           sync.Mutex // serialises journal writes with their in-memory apply
+}
+
+// DefaultCompactAfter is the number of journal records below which the file
+// store never compacts.
+const DefaultCompactAfter = 1000
+
+const (
+	journalOpAdd    = "add"
+	journalOpUpdate = "update"
+	journalOpDelete = "delete"
+	journalOpClicks = "clicks"
+	journalOpLink   = "link" // a link of a snapshot, with its click aggregates
+	journalOpSeq    = "sequence"
+)
+
+type journalEntry struct {
+	Op      string                   `json:"op"`
+	Key     string                   `json:"key,omitempty"`
+	Data    *entities.ShortURLDBData `json:"data,omitempty"`
+	Clicks  []entities.Click         `json:"clicks,omitempty"`
+	Stats   *entities.ClickStats     `json:"stats,omitempty"`
+	Indexed bool                     `json:"indexed,omitempty"` // the link owns the duplicate entry of its URL
+	Seq     uint64                   `json:"seq,omitempty"`     // first unreserved number of the code sequence
+}
+
+// NewFileDatabase opens (or creates) the journal at path and replays it.
+func NewFileDatabase(path string) (*FileDatabase, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	db := &FileDatabase{
+		InMemoryDatabase: NewInMemoryDatabase(),
+		file:             file,
+		path:             path,
+		compactAfter:     DefaultCompactAfter,
+	}
+	if err := db.replay(); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	db.maybeCompact()
+	return db, nil
+}
+
+// replay applies the journal to the in-memory index. A final record that is
+// cut short or does not parse is the trace of a crash during append: it was
+// never acknowledged, so the journal is truncated to the last whole record.
+// Unreadable records elsewhere are corruption and fail the open.
+func (db *FileDatabase) replay() error {
+	reader := bufio.NewReader(db.file)
+	var offset int64
+	for line := 1; ; line++ {
+		record, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(record) > 0 {
+				return db.truncateTorn(offset, line)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var entry journalEntry
+		if err := json.Unmarshal(record, &entry); err != nil {
+			if _, peekErr := reader.Peek(1); peekErr == io.EOF {
+				return db.truncateTorn(offset, line)
+			}
+			return fmt.Errorf("journal %s line %d: %w", db.file.Name(), line, err)
+		}
+		if err := db.apply(entry); err != nil {
+			return fmt.Errorf("journal %s line %d: %w", db.file.Name(), line, err)
+		}
+		offset += int64(len(record))
+		db.records++
+	}
+}
+
+// truncateTorn drops the torn record starting at offset.
+func (db *FileDatabase) truncateTorn(offset int64, line int) error {
+	log.Printf("journal %s: dropping torn record at line %d (offset %d)", db.file.Name(), line, offset)
+	if err := db.file.Truncate(offset); err != nil {
+		return err
+	}
+	return db.file.Sync()
+}
+
+func (db *FileDatabase) apply(entry journalEntry) error {
+	ctx := context.Background()
+	switch entry.Op {
+	case journalOpAdd:
+		if entry.Data == nil {
+			return errors.New("add without data")
+		}
+		// a duplicate add can only come from a crash between append and apply; keep the first one
+		_ = db.InMemoryDatabase.AddData(ctx, entry.Key, *entry.Data)
+	case journalOpUpdate:
+		if entry.Data == nil {
+			return errors.New("update without data")
+		}
+		_ = db.InMemoryDatabase.UpdateData(ctx, entry.Key, *entry.Data)
+	case journalOpDelete:
+		db.InMemoryDatabase.mu.Lock()
+		db.InMemoryDatabase.deleteLocked(entry.Key)
+		db.InMemoryDatabase.mu.Unlock()
+	case journalOpClicks:
+		_ = db.InMemoryDatabase.RecordClicks(ctx, entry.Clicks)
+	case journalOpLink:
+		if entry.Data == nil {
+			return errors.New("link without data")
+		}
+		db.restore(entry)
+	case journalOpSeq:
+		db.InMemoryDatabase.mu.Lock()
+		db.InMemoryDatabase.sequence = max(db.InMemoryDatabase.sequence, entry.Seq)
+		db.InMemoryDatabase.mu.Unlock()
+	default:
+		return fmt.Errorf("unknown op %q", entry.Op)
+	}
+	return nil
+}
+
+func (db *FileDatabase) append(entries ...journalEntry) error {
+	var records []byte
+	for _, entry := range entries {
+		record, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		records = append(append(records, record...), '\n')
+	}
+	if _, err := db.file.Write(records); err != nil {
+		return err
+	}
+	db.records += len(entries)
+	return db.file.Sync()
+}
+
+// restore loads a snapshot record as it was when the snapshot was taken.
+func (db *FileDatabase) restore(entry journalEntry) {
+	mem := db.InMemoryDatabase
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	mem.deleteLocked(entry.Key)
+	mem.shortUrlDB[entry.Key] = *entry.Data
+	mem.repeatUrlDB[entry.Key] = true
+	mem.metricsDB.add(entry.Data.LongURLDomain, entry.Data.CreatedAt)
+	if entry.Indexed {
+		mem.longUrlDB[dedupKey(entry.Key, entry.Data.Owner, entry.Data.LongURL)] = entry.Key
+	}
+	if entry.Stats != nil {
+		mem.clicksDB[entry.Key] = cloneClickStats(entry.Stats)
+	}
+}
+
+// maybeCompact compacts the journal once it is worth it. Failures are logged
+// and leave the journal as it was. The caller must hold db.mu, or own db.
+func (db *FileDatabase) maybeCompact() {
+	if db.records < db.compactAfter || db.records <= 2*db.InMemoryDatabase.CountLinks(context.Background()) {
+		return
+	}
+	before := db.records
+	if err := db.compact(); err != nil {
+		log.Printf("could not compact journal %s: %s", db.path, err)
+		return
+	}
+	log.Printf("compacted journal %s from %d to %d records", db.path, before, db.records)
+}
+
+// compact writes a snapshot of the store next to the journal and renames it
+// over the journal, so a crash leaves either the old journal or the snapshot.
+func (db *FileDatabase) compact() error {
+	tmpPath := db.path + ".compact"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	records, err := db.writeSnapshot(tmp)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, db.path)
+	}
+	if err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	// the snapshot is the journal now, whatever happens to the directory entry
+	if dir, err := os.Open(filepath.Dir(db.path)); err == nil {
+		_ = dir.Sync()
+		_ = dir.Close()
+	}
+	_ = db.file.Close()
+	db.file = tmp
+	db.records = records
+	return nil
+}
+
+// writeSnapshot writes one link record per stored link to w, and the
+// position of the code sequence.
+func (db *FileDatabase) writeSnapshot(w io.Writer) (int, error) {
+	mem := db.InMemoryDatabase
+	mem.mu.RLock()
+	defer mem.mu.RUnlock()
+	buf := bufio.NewWriter(w)
+	encoder := json.NewEncoder(buf)
+	records := len(mem.shortUrlDB)
+	if mem.sequence > 0 {
+		if err := encoder.Encode(journalEntry{Op: journalOpSeq, Seq: mem.sequence}); err != nil {
+			return 0, err
+		}
+		records++
+	}
+	for key, data := range mem.shortUrlDB {
+		entry := journalEntry{
+			Op:      journalOpLink,
+			Key:     key,
+			Data:    &data,
+			Stats:   mem.clicksDB[key],
+			Indexed: mem.longUrlDB[dedupKey(key, data.Owner, data.LongURL)] == key,
+		}
+		if err := encoder.Encode(entry); err != nil {
+			return 0, err
+		}
+	}
+	return records, buf.Flush()
+}
+
+func (db *FileDatabase) AddData(ctx context.Context, key string, data entities.ShortURLDBData) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.InMemoryDatabase.RetrieveData(ctx, key) != nil {
+		return ErrURLAlreadyShortened
+	}
+	if err := db.append(journalEntry{Op: journalOpAdd, Key: key, Data: &data}); err != nil {
+		return err
+	}
+	return db.InMemoryDatabase.AddData(ctx, key, data)
+}
+
+func (db *FileDatabase) GetOrCreate(ctx context.Context, key string, data entities.ShortURLDBData) (*entities.ShortURLDBData, bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.InMemoryDatabase.mu.RLock()
+	existing := db.liveDuplicateLocked(key, data)
+	_, taken := db.shortUrlDB[key]
+	db.InMemoryDatabase.mu.RUnlock()
+	if existing != nil {
+		return existing, false, nil
+	}
+	if taken {
+		return nil, false, ErrURLAlreadyShortened
+	}
+	if err := db.append(journalEntry{Op: journalOpAdd, Key: key, Data: &data}); err != nil {
+		return nil, false, err
+	}
+	// db.mu keeps other writers out, so this creates the link
+	return db.InMemoryDatabase.GetOrCreate(ctx, key, data)
+}
+
+func (db *FileDatabase) UpdateData(ctx context.Context, key string, data entities.ShortURLDBData) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.InMemoryDatabase.RetrieveData(ctx, key) == nil {
+		return ErrKeyNotFound
+	}
+	if err := db.append(journalEntry{Op: journalOpUpdate, Key: key, Data: &data}); err != nil {
+		return err
+	}
+	return db.InMemoryDatabase.UpdateData(ctx, key, data)
+}
+
+func (db *FileDatabase) DeleteData(ctx context.Context, key string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.InMemoryDatabase.RetrieveData(ctx, key) == nil {
+		return ErrKeyNotFound
+	}
+	if err := db.append(journalEntry{Op: journalOpDelete, Key: key}); err != nil {
+		return err
+	}
+	return db.InMemoryDatabase.DeleteData(ctx, key)
+}
+
+// PurgeExpired removes expired links and journals their deletion, then
+// compacts the journal if it has grown. If the journal write fails the links
+// only come back after a restart, where the next purge removes them again.
+func (db *FileDatabase) PurgeExpired(ctx context.Context, now time.Time) int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	defer db.maybeCompact()
+	removed := db.InMemoryDatabase.purgeExpired(now)
+	if len(removed) == 0 {
+		return 0
+	}
+	entries := make([]journalEntry, 0, len(removed))
+	for _, key := range removed {
+		entries = append(entries, journalEntry{Op: journalOpDelete, Key: key})
+	}
+	if err := db.append(entries...); err != nil {
+		log.Printf("could not journal %d purged links: %s", len(removed), err)
+	}
+	return len(removed)
+}
+
+// RecordClicks journals a batch of clicks as a single record.
+func (db *FileDatabase) RecordClicks(ctx context.Context, clicks []entities.Click) error {
+	if len(clicks) == 0 {
+		return nil
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.append(journalEntry{Op: journalOpClicks, Clicks: clicks}); err != nil {
+		return err
+	}
+	return db.InMemoryDatabase.RecordClicks(ctx, clicks)
+}
+
+// ReserveSequence journals the new position of the code sequence before
+// handing out the numbers.
+func (db *FileDatabase) ReserveSequence(ctx context.Context, n uint64) (uint64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.InMemoryDatabase.mu.RLock()
+	next := db.InMemoryDatabase.sequence + n
+	db.InMemoryDatabase.mu.RUnlock()
+	if err := db.append(journalEntry{Op: journalOpSeq, Seq: next}); err != nil {
+		return 0, err
+	}
+	// db.mu keeps other writers out, so this reserves the journaled numbers
+	return db.InMemoryDatabase.ReserveSequence(ctx, n)
+}
+
+// Close flushes and closes the journal file.
+func (db *FileDatabase) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.file.Sync(); err != nil {
+		_ = db.file.Close()
+		return err
+	}
+	return db.file.Close()
+}
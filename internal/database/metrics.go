@@ -0,0 +1,137 @@
+package database
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"time"
+	"urlshortener/internal/entities"
+)
+
+// TopDomainWindows are the time windows top domains are ranked over; zero
+// stands for all time.
+var TopDomainWindows = []time.Duration{0, time.Hour, 24 * time.Hour, 7 * 24 * time.Hour}
+
+// bucketRetention is how long minute buckets are kept: the largest window
+// plus the partially elapsed minute at its start.
+var bucketRetention = TopDomainWindows[len(TopDomainWindows)-1] + time.Minute
+
+// domainCounters tallies live links per long URL domain, both in total and in
+// minute buckets of their creation time, so recent activity can be ranked.
+// Windows are counted to the minute: a link created in the minute the window
+// starts in is counted, even when it is a few seconds older than the window.
+type domainCounters struct {
+	domains map[string]*domainTally
+}
+
+type domainTally struct {
+	total    int
+	byMinute map[int64]int // keyed by unix minute of creation
+}
+
+func newDomainCounters() *domainCounters {
+	return &domainCounters{domains: make(map[string]*domainTally)}
+}
+
+func unixMinute(t time.Time) int64 {
+	return t.Unix() / 60
+}
+
+func (c *domainCounters) add(domain string, createdAt time.Time) {
+	tally, ok := c.domains[domain]
+	if !ok {
+		tally = &domainTally{byMinute: make(map[int64]int)}
+		c.domains[domain] = tally
+	}
+	tally.total++
+	tally.byMinute[unixMinute(createdAt)]++
+}
+
+func (c *domainCounters) remove(domain string, createdAt time.Time) {
+	tally, ok := c.domains[domain]
+	if !ok {
+		return
+	}
+	tally.total--
+	minute := unixMinute(createdAt)
+	if tally.byMinute[minute] > 1 {
+		tally.byMinute[minute]--
+	} else {
+		delete(tally.byMinute, minute)
+	}
+	if tally.total <= 0 {
+		delete(c.domains, domain)
+	}
+}
+
+func (c *domainCounters) len() int {
+	return len(c.domains)
+}
+
+// prune drops minute buckets that fall outside every window.
+func (c *domainCounters) prune(now time.Time) {
+	oldest := unixMinute(now.Add(-bucketRetention))
+	for _, tally := range c.domains {
+		for minute := range tally.byMinute {
+			if minute < oldest {
+				delete(tally.byMinute, minute)
+			}
+		}
+	}
+}
+
+// rank orders domains by the number of links created within window of now,
+// or by their live total when window is zero. Ties are broken by name.
+func (c *domainCounters) rank(window time.Duration, now time.Time) []entities.TopDomains {
+	oldest := unixMinute(now.Add(-window))
+	ranked := make([]entities.TopDomains, 0, len(c.domains))
+	for domain, tally := range c.domains {
+		count := tally.total
+		if window > 0 {
+			count = 0
+			for minute, n := range tally.byMinute {
+				if minute >= oldest {
+					count += n
+				}
+			}
+		}
+		if count > 0 {
+			ranked = append(ranked, entities.TopDomains{Domain: domain, Count: count})
+		}
+	}
+	slices.SortFunc(ranked, func(a, b entities.TopDomains) int {
+		if a.Count != b.Count {
+			return b.Count - a.Count
+		}
+		return strings.Compare(a.Domain, b.Domain)
+	})
+	return ranked
+}
+
+// PopulateTopDomains refreshes the ranking snapshot of every window. Ranking
+// runs under the read lock; the write lock is only held to prune and swap.
+func (db *InMemoryDatabase) PopulateTopDomains(ctx context.Context, now time.Time) {
+	db.mu.RLock()
+	topDomains := make(map[time.Duration][]entities.TopDomains, len(TopDomainWindows))
+	for _, window := range TopDomainWindows {
+		topDomains[window] = db.metricsDB.rank(window, now)
+	}
+	db.mu.RUnlock()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.metricsDB.prune(now)
+	db.topDomains = topDomains
+}
+
+// RetrieveTopDomains returns up to limit domains from the last snapshot of
+// window, which must be one of TopDomainWindows.
+func (db *InMemoryDatabase) RetrieveTopDomains(ctx context.Context, limit int, window time.Duration) []entities.TopDomains {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	ranked := db.topDomains[window]
+	if len(ranked) > limit {
+		ranked = ranked[:limit]
+	}
+	return append([]entities.TopDomains{}, ranked...)
+}
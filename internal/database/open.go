@@ -0,0 +1,32 @@
+package database
+
+import "fmt"
+
+// Names of the DB backends, as accepted by Open.
+const (
+	MemoryStore  = "memory"
+	ShardedStore = "sharded"
+	FileStore    = "file"
+)
+
+// Stores lists the backend names, the default first.
+var Stores = []string{MemoryStore, ShardedStore, FileStore}
+
+// Open returns the backend called store. path is the journal of the file
+// store, which is replayed if it exists, and is ignored by the others.
+// Backends that hold files implement io.Closer.
+func Open(store, path string) (DB, error) {
+	switch store {
+	case MemoryStore:
+		return NewInMemoryDatabase(), nil
+	case ShardedStore:
+		return NewShardedDatabase(DefaultShards), nil
+	case FileStore:
+		db, err := NewFileDatabase(path)
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+	}
+	return nil, fmt.Errorf("unknown storage backend %q", store)
+}
@@ -0,0 +1,335 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+	"urlshortener/internal/entities"
+)
+
+// DefaultShards is the number of link shards of the sharded store.
+const DefaultShards = 64
+
+// ShardedDatabase is an in-memory DB built for redirect volume. Links are
+// spread over lock-striped shards by a hash of their key. Lookups are not
+// lock-free: they take the read lock of their shard, so they only wait for
+// writes to links of the same shard. The duplicate URL index is striped by
+// long URL and the domain counters have a lock of their own, so neither
+// creating links nor refreshing the top domains stalls redirects. Only link
+// counts and top domain snapshots are read without a lock, from atomics.
+//
+// Lock-free lookups were measured with BenchmarkDB_MixedLoad: a sync.Map per
+// shard made them slower at every write ratio, and a copy-on-write map would
+// copy the whole shard on every write.
+type ShardedDatabase struct {
+	shards     []linkShard
+	dedup      []dedupStripe
+	mask       uint32
+	count      atomic.Int64
+	sequence   atomic.Uint64 // next unreserved number of the code sequence
+	metricsMu  sync.Mutex
+	metricsDB  *domainCounters
+	topDomains atomic.Pointer[map[time.Duration][]entities.TopDomains]
+}
+
+type linkShard struct {
+	mu     sync.RWMutex
+	links  map[string]*entities.ShortURLDBData // an update stores a new link, so a loaded one is never written
+	clicks map[string]*entities.ClickStats
+	_      [24]byte // keep neighbouring shards' locks on separate cache lines
+}
+
+// dedupStripe holds part of the duplicate URL index. Its entries are hints:
+// they are checked against the link they name before being trusted, so links
+// can be removed without holding a stripe and a shard at once.
+type dedupStripe struct {
+	mu   sync.Mutex
+	keys map[string]string // dedupKey -> link key
+}
+
+// NewShardedDatabase returns an empty store of n shards, rounded up to a
+// power of two; n < 1 means DefaultShards.
+func NewShardedDatabase(n int) *ShardedDatabase {
+	if n < 1 {
+		n = DefaultShards
+	}
+	size := 1
+	for size < n {
+		size <<= 1
+	}
+	db := &ShardedDatabase{
+		shards:    make([]linkShard, size),
+		dedup:     make([]dedupStripe, size),
+		mask:      uint32(size - 1),
+		metricsDB: newDomainCounters(),
+	}
+	for i := range db.shards {
+		db.shards[i].links = make(map[string]*entities.ShortURLDBData)
+		db.shards[i].clicks = make(map[string]*entities.ClickStats)
+		db.dedup[i].keys = make(map[string]string)
+	}
+	db.topDomains.Store(&map[time.Duration][]entities.TopDomains{})
+	return db
+}
+
+// fnv32a hashes key with 32-bit FNV-1a without allocating.
+func fnv32a(key string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return h
+}
+
+func (db *ShardedDatabase) shardOf(key string) *linkShard {
+	return &db.shards[fnv32a(key)&db.mask]
+}
+
+func (db *ShardedDatabase) stripeOf(dedupKey string) *dedupStripe {
+	return &db.dedup[fnv32a(dedupKey)&db.mask]
+}
+
+// load returns the stored link of key. The result must not be modified.
+func (db *ShardedDatabase) load(key string) *entities.ShortURLDBData {
+	shard := db.shardOf(key)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	return shard.links[key]
+}
+
+// indexed returns the key a dedup entry names, if that link still exists and
+// still points at the entry's URL.
+func (db *ShardedDatabase) indexed(stripe *dedupStripe, dk string) (string, *entities.ShortURLDBData) {
+	key, ok := stripe.keys[dk]
+	if !ok {
+		return "", nil
+	}
+	link := db.load(key)
+	if link == nil || dedupKey(key, link.Owner, link.LongURL) != dk {
+		return "", nil
+	}
+	return key, link
+}
+
+// insert stores a new link, reporting false when key is taken.
+func (db *ShardedDatabase) insert(key string, data entities.ShortURLDBData) bool {
+	shard := db.shardOf(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if _, taken := shard.links[key]; taken {
+		return false
+	}
+	shard.links[key] = &data
+	db.count.Add(1)
+	db.countDomain(nil, &data)
+	return true
+}
+
+// countDomain moves a link between domain counters: from old, to data, or
+// both on an update. The caller must hold the link's shard lock, so updates
+// of one link are counted in the order they are applied.
+func (db *ShardedDatabase) countDomain(old, data *entities.ShortURLDBData) {
+	if old != nil && data != nil && old.LongURLDomain == data.LongURLDomain {
+		return
+	}
+	db.metricsMu.Lock()
+	defer db.metricsMu.Unlock()
+	if old != nil {
+		db.metricsDB.remove(old.LongURLDomain, old.CreatedAt)
+	}
+	if data != nil {
+		db.metricsDB.add(data.LongURLDomain, data.CreatedAt)
+	}
+}
+
+func (db *ShardedDatabase) AddData(ctx context.Context, key string, data entities.ShortURLDBData) error {
+	dk := dedupKey(key, data.Owner, data.LongURL)
+	stripe := db.stripeOf(dk)
+	stripe.mu.Lock()
+	defer stripe.mu.Unlock()
+	if !db.insert(key, data) {
+		return ErrURLAlreadyShortened
+	}
+	stripe.keys[dk] = key
+	return nil
+}
+
+// GetOrCreate holds the stripe of the long URL throughout, so concurrent
+// creators of one URL are serialised while other URLs proceed.
+func (db *ShardedDatabase) GetOrCreate(ctx context.Context, key string, data entities.ShortURLDBData) (*entities.ShortURLDBData, bool, error) {
+	dk := dedupKey(key, data.Owner, data.LongURL)
+	stripe := db.stripeOf(dk)
+	stripe.mu.Lock()
+	defer stripe.mu.Unlock()
+	if _, existing := db.indexed(stripe, dk); existing != nil && !existing.Expired(data.CreatedAt) && !existing.Disabled {
+		link := *existing
+		return &link, false, nil
+	}
+	if !db.insert(key, data) {
+		return nil, false, ErrURLAlreadyShortened
+	}
+	stripe.keys[dk] = key
+	return &data, true, nil
+}
+
+func (db *ShardedDatabase) CheckDuplicateRequest(ctx context.Context, key string) error {
+	if db.load(key) != nil {
+		return errors.New("Duplicate Request")
+	}
+	return nil
+}
+
+func (db *ShardedDatabase) RetrieveData(ctx context.Context, key string) *entities.ShortURLDBData {
+	if link := db.load(key); link != nil {
+		result := *link
+		return &result
+	}
+	return nil
+}
+
+func (db *ShardedDatabase) RetrieveDuplicateURL(ctx context.Context, dk string) string {
+	stripe := db.stripeOf(dk)
+	stripe.mu.Lock()
+	defer stripe.mu.Unlock()
+	key, _ := db.indexed(stripe, dk)
+	return key
+}
+
+func (db *ShardedDatabase) UpdateData(ctx context.Context, key string, data entities.ShortURLDBData) error {
+	shard := db.shardOf(key)
+	shard.mu.Lock()
+	old := shard.links[key]
+	if old == nil {
+		shard.mu.Unlock()
+		return ErrKeyNotFound
+	}
+	data.ShortURl = old.ShortURl
+	data.CreatedAt = old.CreatedAt
+	shard.links[key] = &data
+	db.countDomain(old, &data)
+	shard.mu.Unlock()
+
+	if dk := dedupKey(key, data.Owner, data.LongURL); dk != dedupKey(key, old.Owner, old.LongURL) {
+		db.unindex(key, old)
+		// never steal the duplicate entry of another live link
+		stripe := db.stripeOf(dk)
+		stripe.mu.Lock()
+		if other, _ := db.indexed(stripe, dk); other == "" {
+			stripe.keys[dk] = key
+		}
+		stripe.mu.Unlock()
+	}
+	return nil
+}
+
+// unindex drops the dedup entry of link if it names key and key no longer
+// holds that link's URL.
+func (db *ShardedDatabase) unindex(key string, link *entities.ShortURLDBData) {
+	dk := dedupKey(key, link.Owner, link.LongURL)
+	stripe := db.stripeOf(dk)
+	stripe.mu.Lock()
+	defer stripe.mu.Unlock()
+	if stripe.keys[dk] != key {
+		return
+	}
+	if indexed, _ := db.indexed(stripe, dk); indexed == "" {
+		delete(stripe.keys, dk)
+	}
+}
+
+func (db *ShardedDatabase) DeleteData(ctx context.Context, key string) error {
+	shard := db.shardOf(key)
+	shard.mu.Lock()
+	data, ok := shard.links[key]
+	if ok {
+		db.deleteLocked(shard, key, data)
+	}
+	shard.mu.Unlock()
+	if !ok {
+		return ErrKeyNotFound
+	}
+	db.unindex(key, data)
+	return nil
+}
+
+// deleteLocked removes the link of key from its shard and the counters. The
+// caller must hold the shard lock, and unindex the link afterwards.
+func (db *ShardedDatabase) deleteLocked(shard *linkShard, key string, data *entities.ShortURLDBData) {
+	delete(shard.links, key)
+	delete(shard.clicks, key)
+	db.count.Add(-1)
+	db.countDomain(data, nil)
+}
+
+// PurgeExpired locks one shard at a time.
+func (db *ShardedDatabase) PurgeExpired(ctx context.Context, now time.Time) int {
+	purged := 0
+	for i := range db.shards {
+		shard := &db.shards[i]
+		removed := map[string]*entities.ShortURLDBData{}
+		shard.mu.Lock()
+		for key, data := range shard.links {
+			if data.Expired(now) {
+				db.deleteLocked(shard, key, data)
+				removed[key] = data
+			}
+		}
+		shard.mu.Unlock()
+		for key, data := range removed {
+			db.unindex(key, data)
+		}
+		purged += len(removed)
+	}
+	return purged
+}
+
+func (db *ShardedDatabase) CountLinks(ctx context.Context) int {
+	return int(db.count.Load())
+}
+
+func (db *ShardedDatabase) ReserveSequence(ctx context.Context, n uint64) (uint64, error) {
+	return db.sequence.Add(n) - n, nil
+}
+
+// PopulateTopDomains only holds the domain counters' lock, and publishes the
+// snapshot atomically.
+func (db *ShardedDatabase) PopulateTopDomains(ctx context.Context, now time.Time) {
+	topDomains := make(map[time.Duration][]entities.TopDomains, len(TopDomainWindows))
+	db.metricsMu.Lock()
+	for _, window := range TopDomainWindows {
+		topDomains[window] = db.metricsDB.rank(window, now)
+	}
+	db.metricsDB.prune(now)
+	db.metricsMu.Unlock()
+	db.topDomains.Store(&topDomains)
+}
+
+func (db *ShardedDatabase) RetrieveTopDomains(ctx context.Context, limit int, window time.Duration) []entities.TopDomains {
+	ranked := (*db.topDomains.Load())[window]
+	if len(ranked) > limit {
+		ranked = ranked[:limit]
+	}
+	return append([]entities.TopDomains{}, ranked...)
+}
+
+func (db *ShardedDatabase) RecordClicks(ctx context.Context, clicks []entities.Click) error {
+	for _, click := range clicks {
+		shard := db.shardOf(click.Code)
+		shard.mu.Lock()
+		if _, ok := shard.links[click.Code]; ok {
+			addClick(shard.clicks, click)
+		}
+		shard.mu.Unlock()
+	}
+	return nil
+}
+
+func (db *ShardedDatabase) RetrieveClickStats(ctx context.Context, key string) *entities.ClickStats {
+	shard := db.shardOf(key)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	return cloneClickStats(shard.clicks[key])
+}
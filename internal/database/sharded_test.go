@@ -0,0 +1,168 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"urlshortener/internal/entities"
+)
+
+func TestNewShardedDatabase(t *testing.T) {
+	assert.Len(t, NewShardedDatabase(0).shards, DefaultShards)
+	assert.Len(t, NewShardedDatabase(1).shards, 1)
+	assert.Len(t, NewShardedDatabase(48).shards, 64)
+}
+
+// Test that the indexes stay consistent while every operation runs at once.
+// Run with -race.
+func TestShardedDatabase_ConcurrentMixedLoad(t *testing.T) {
+	db := NewShardedDatabase(8)
+	ctx := context.Background()
+	const workers, ops, urls = 16, 500, 50
+	stop := make(chan struct{})
+	var refreshes sync.WaitGroup
+	refreshes.Add(1)
+	go func() {
+		defer refreshes.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				db.PopulateTopDomains(ctx, time.Now())
+				db.PurgeExpired(ctx, time.Now())
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := rand.New(rand.NewPCG(uint64(w), 1))
+			for i := 0; i < ops; i++ {
+				code := fmt.Sprintf("W%dO%d", w, i)
+				longURL := fmt.Sprintf("https://a.com/%d", r.IntN(urls))
+				switch op := r.IntN(10); {
+				case op < 3:
+					data := sampleData(code, longURL, "a.com")
+					if r.IntN(4) == 0 {
+						data.ExpiryDate = time.Now().Add(-time.Second)
+					}
+					_, _, err := db.GetOrCreate(ctx, code, data)
+					assert.NoError(t, err)
+				case op < 4:
+					if key := db.RetrieveDuplicateURL(ctx, longURL); key != "" {
+						_ = db.UpdateData(ctx, key, sampleData(key, fmt.Sprintf("https://b.com/%d", r.IntN(urls)), "b.com"))
+					}
+				case op < 5:
+					if key := db.RetrieveDuplicateURL(ctx, longURL); key != "" {
+						_ = db.DeleteData(ctx, key)
+					}
+				case op < 6:
+					if key := db.RetrieveDuplicateURL(ctx, longURL); key != "" {
+						_ = db.RecordClicks(ctx, []entities.Click{{Code: key, Time: time.Now()}})
+					}
+				default:
+					if key := db.RetrieveDuplicateURL(ctx, longURL); key != "" {
+						db.RetrieveData(ctx, key)
+						db.RetrieveClickStats(ctx, key)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	refreshes.Wait()
+
+	// every link is counted once and every duplicate entry names a live link
+	links, total := 0, 0
+	for i := range db.shards {
+		links += len(db.shards[i].links)
+	}
+	assert.Equal(t, links, db.CountLinks(ctx))
+	for i := range db.dedup {
+		for dk := range db.dedup[i].keys {
+			if key := db.RetrieveDuplicateURL(ctx, dk); key != "" {
+				require.NotNil(t, db.RetrieveData(ctx, key), dk)
+			}
+		}
+	}
+	db.PopulateTopDomains(ctx, time.Now())
+	for _, domain := range db.RetrieveTopDomains(ctx, 10, 0) {
+		total += domain.Count
+	}
+	assert.Equal(t, links, total, "domain counters match the stored links")
+}
+
+// benchmarkMixedLoad runs redirect lookups against newDB, turning writes per
+// cent of the operations into link creations, while the top domains are
+// refreshed in the background as the server does.
+func benchmarkMixedLoad(b *testing.B, newDB func() DB, writes int) {
+	const links = 100000
+	db := newDB()
+	ctx := context.Background()
+	codes := make([]string, links)
+	for i := range codes {
+		codes[i] = fmt.Sprintf("C%d", i)
+		_, _, err := db.GetOrCreate(ctx, codes[i], sampleData(codes[i], fmt.Sprintf("https://a%d.com/%d", i%100, i), fmt.Sprintf("a%d.com", i%100)))
+		require.NoError(b, err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-ticker.C:
+				db.PopulateTopDomains(ctx, now)
+			}
+		}
+	}()
+
+	var worker atomic.Uint64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		w := worker.Add(1)
+		r := rand.New(rand.NewPCG(w, 2))
+		for i := 0; pb.Next(); i++ {
+			if r.IntN(100) < writes {
+				code := fmt.Sprintf("W%dN%d", w, i)
+				_, _, _ = db.GetOrCreate(ctx, code, sampleData(code, "https://b.com/"+code, "b.com"))
+				continue
+			}
+			db.RetrieveData(ctx, codes[r.IntN(links)])
+		}
+	})
+}
+
+// Compare the single lock store with the sharded one, e.g.
+//
+//	go test ./internal/database -run XXX -bench MixedLoad -cpu 1,4,16
+func BenchmarkDB_MixedLoad(b *testing.B) {
+	stores := []struct {
+		name  string
+		newDB func() DB
+	}{
+		{"memory", func() DB { return NewInMemoryDatabase() }},
+		{"sharded", func() DB { return NewShardedDatabase(DefaultShards) }},
+	}
+	for _, writes := range []int{0, 1, 10, 50} {
+		for _, store := range stores {
+			b.Run(fmt.Sprintf("%s/writes=%d%%", store.name, writes), func(b *testing.B) {
+				benchmarkMixedLoad(b, store.newDB, writes)
+			})
+		}
+	}
+}
@@ -5,12 +5,37 @@ import "time"
 type ShortenURLRequest struct {
 	LongURL string `json:"longURL"`
 	Domain  string `json:"domain"`
+	Alias   string `json:"alias,omitempty"` // optional vanity short code
+	// Optional expiry: either an absolute timestamp or a ttl ("36h", "30d", "never").
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	TTL       string     `json:"ttl,omitempty"`
+	// Optional HTTP status used when redirecting: 301, 302, 307 or 308.
+	RedirectType int `json:"redirectType,omitempty"`
+	// ID of the API key creating the link, set by the server and never read from the body.
+	Owner string `json:"-"`
 }
 
 type ShortenURLResponse struct {
-	ShortURl   string `json:"shortURL"`
-	CreatedAt  time.Time
-	ExpiryDate time.Time
+	ShortURl     string `json:"shortURL"`
+	CreatedAt    time.Time
+	ExpiryDate   time.Time
+	RedirectType int    `json:"redirectType"`
+	Status       string `json:"status"` // one of LinkCreated, LinkExisting, LinkReissued
+}
+
+// Outcomes reported in ShortenURLResponse.Status.
+const (
+	LinkCreated  = "created"  // a new short code was minted
+	LinkExisting = "existing" // the live link already issued for this URL was returned
+	LinkReissued = "reissued" // the previous link had expired, so a new code was minted
+)
+
+// BulkShortenResult is the outcome of one item of POST /shortURL/bulk; exactly
+// one of Result and Error is set.
+type BulkShortenResult struct {
+	Index  int                 `json:"index"`
+	Result *ShortenURLResponse `json:"result,omitempty"`
+	Error  *ErrorDetail        `json:"error,omitempty"`
 }
 
 type ShortURLDBData struct {
@@ -19,15 +44,96 @@ type ShortURLDBData struct {
 	LongURLDomain string
 	ShortURl      string
 	CreatedAt     time.Time
-	ExpiryDate    time.Time
+	ExpiryDate    time.Time // zero value means the link never expires
+	RedirectType  int       // HTTP redirect status, zero means the server default
+	Owner         string    // ID of the API key that created the link, empty without authentication
+	Disabled      bool      // kept but no longer redirecting
+}
+
+// Expired reports whether the link is no longer valid at now.
+func (d *ShortURLDBData) Expired(now time.Time) bool {
+	return !d.ExpiryDate.IsZero() && !now.Before(d.ExpiryDate)
+}
+
+// LinkResponse describes a stored link, as returned by the link management API.
+type LinkResponse struct {
+	ShortURL     string    `json:"shortURL"`
+	Code         string    `json:"code"`
+	LongURL      string    `json:"longURL"`
+	CreatedAt    time.Time `json:"createdAt"`
+	ExpiryDate   time.Time `json:"expiryDate"` // zero when the link never expires
+	Expired      bool      `json:"expired"`
+	RedirectType int       `json:"redirectType"`
+	Disabled     bool      `json:"disabled"`
+	Owner        string    `json:"owner,omitempty"`
+}
+
+// UpdateLinkRequest is the body of PATCH /api/links/{id}. Only the fields
+// present are changed.
+type UpdateLinkRequest struct {
+	LongURL *string `json:"longURL,omitempty"`
+	// New expiry, either an absolute timestamp or a ttl from now ("36h", "30d", "never").
+	ExpiresAt    *time.Time `json:"expiresAt,omitempty"`
+	TTL          string     `json:"ttl,omitempty"`
+	RedirectType *int       `json:"redirectType,omitempty"`
+	Disabled     *bool      `json:"disabled,omitempty"`
 }
 
 type RedirectShortURLResponse struct {
-	LongURl string
-	Domain  string
+	LongURl    string
+	Domain     string
+	StatusCode int // HTTP redirect status to answer with
 }
 
 type TopDomains struct {
 	Domain string
 	Count  int
 }
+
+// ErrorResponse is the JSON envelope written for every failed API call.
+type ErrorResponse struct {
+	Error ErrorDetail `json:"error"`
+}
+
+type ErrorDetail struct {
+	Code    string `json:"code"`    // machine readable, e.g. "not_found"
+	Message string `json:"message"` // human readable description
+}
+
+// Click is one followed redirect as recorded for analytics.
+type Click struct {
+	Code     string
+	Time     time.Time
+	Referrer string // referring host, empty for direct traffic
+	Device   string // coarse client class: desktop, mobile, bot or unknown
+	Browser  string // browser family, e.g. Chrome or Firefox
+}
+
+// ClickStats aggregates the clicks of one short link.
+type ClickStats struct {
+	Total     int
+	Daily     map[string]int // keyed by UTC date, 2006-01-02
+	Referrers map[string]int
+	Devices   map[string]int
+	Browsers  map[string]int
+}
+
+// LinkStatsResponse is returned by GET /{id}/stats.
+type LinkStatsResponse struct {
+	ShortURL     string        `json:"shortURL"`
+	TotalClicks  int           `json:"totalClicks"`
+	ClicksPerDay []DailyClicks `json:"clicksPerDay"`
+	TopReferrers []NamedCount  `json:"topReferrers"`
+	Devices      []NamedCount  `json:"devices"`
+	Browsers     []NamedCount  `json:"browsers"`
+}
+
+type DailyClicks struct {
+	Date   string `json:"date"`
+	Clicks int    `json:"clicks"`
+}
+
+type NamedCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
@@ -0,0 +1,175 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"urlshortener/internal/auth"
+	"urlshortener/internal/entities"
+	"urlshortener/internal/middleware"
+	"urlshortener/internal/service"
+)
+
+// ContentTypeNDJSON selects streaming bulk requests: one ShortenURLRequest per
+// line in, one BulkShortenResult per line out.
+const ContentTypeNDJSON = "application/x-ndjson"
+
+// maxBulkBodyBytes bounds a JSON array bulk request body.
+const maxBulkBodyBytes = 32 << 20
+
+// maxNDJSONLineBytes bounds one streamed request line.
+const maxNDJSONLineBytes = 1 << 20
+
+// BulkShortenHandler serves POST /shortURL/bulk. The body is either a JSON
+// array of ShortenURLRequest answered with an array of BulkShortenResult in
+// the same order, or NDJSON (Content-Type: application/x-ndjson) answered
+// with NDJSON results streamed in batches. A failing item does not fail the
+// request.
+//
+// Every item costs a token of the innermost rate limit, the bulk quota, the
+// first one paid by the request itself. A JSON array the client cannot pay
+// for in full is rejected with 429; a stream is cut off at the first batch it
+// cannot pay for, whose items are answered with rate_limited errors.
+func (a *App) BulkShortenHandler() http.HandlerFunc {
+	f := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		switch request.Method {
+		case http.MethodPost:
+			mediaType, _, _ := mime.ParseMediaType(request.Header.Get("Content-Type"))
+			if mediaType == ContentTypeNDJSON {
+				a.bulkShortenNDJSON(writer, request)
+				return
+			}
+			a.bulkShortenJSON(writer, request)
+		default:
+			writeMethodNotAllowed(writer, http.MethodPost)
+		}
+	})
+	return f
+}
+
+func (a *App) bulkShortenJSON(writer http.ResponseWriter, request *http.Request) {
+	var requests []entities.ShortenURLRequest
+	err := json.NewDecoder(http.MaxBytesReader(writer, request.Body, maxBulkBodyBytes)).Decode(&requests)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(writer, http.StatusRequestEntityTooLarge, CodeInvalidRequest, err.Error())
+			return
+		}
+		writeError(writer, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+		return
+	}
+	if len(requests) > service.MaxBulkItems {
+		writeServiceError(writer, service.ErrTooManyItems)
+		return
+	}
+	if ok, wait := middleware.Take(request.Context(), len(requests)-1); !ok {
+		middleware.WriteRateLimited(writer, wait)
+		return
+	}
+	owner := auth.KeyID(request.Context())
+	for i := range requests {
+		requests[i].Owner = owner
+	}
+	results, err := a.service.ShortenURLs(context.Background(), requests)
+	if err != nil {
+		writeServiceError(writer, err)
+		return
+	}
+	out := make([]entities.BulkShortenResult, len(results))
+	for i, result := range results {
+		out[i] = bulkResult(i, result)
+	}
+	writeJSON(writer, http.StatusOK, out)
+}
+
+func (a *App) bulkShortenNDJSON(writer http.ResponseWriter, request *http.Request) {
+	owner := auth.KeyID(request.Context())
+	scanner := bufio.NewScanner(request.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxNDJSONLineBytes)
+	encoder := json.NewEncoder(writer)
+	flusher, _ := writer.(http.Flusher)
+
+	index := 0
+	started := false // the status is only sent with the first batch
+	paid := 1        // tokens paid and not used by an item yet
+	var batch []entities.ShortenURLRequest
+	var lineErrs []error // decoding error of each batch line, nil when it parsed
+	// flush shortens and answers the batch, reporting false when the client
+	// could not pay for it.
+	flush := func() bool {
+		ok, wait := middleware.Take(request.Context(), len(batch)-paid)
+		paid = max(paid-len(batch), 0)
+		if !ok && !started {
+			middleware.WriteRateLimited(writer, wait)
+			return false
+		}
+		if !started {
+			writer.Header().Set("Content-Type", ContentTypeNDJSON)
+			writer.WriteHeader(http.StatusOK)
+			started = true
+		}
+		if !ok {
+			for range batch {
+				_ = encoder.Encode(entities.BulkShortenResult{Index: index, Error: &entities.ErrorDetail{Code: middleware.CodeRateLimited, Message: "rate limit exceeded, retry later"}})
+				index++
+			}
+			return false
+		}
+		var valid []entities.ShortenURLRequest
+		for i, err := range lineErrs {
+			if err == nil {
+				valid = append(valid, batch[i])
+			}
+		}
+		results, _ := a.service.ShortenURLs(context.Background(), valid)
+		for _, err := range lineErrs {
+			var out entities.BulkShortenResult
+			if err != nil {
+				out = entities.BulkShortenResult{Index: index, Error: &entities.ErrorDetail{Code: CodeInvalidRequest, Message: err.Error()}}
+			} else {
+				out = bulkResult(index, results[0])
+				results = results[1:]
+			}
+			_ = encoder.Encode(out)
+			index++
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		batch, lineErrs = batch[:0], lineErrs[:0]
+		return true
+	}
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var req entities.ShortenURLRequest
+		err := json.Unmarshal(line, &req)
+		req.Owner = owner
+		batch = append(batch, req)
+		lineErrs = append(lineErrs, err)
+		if len(batch) == service.BulkBatchSize && !flush() {
+			return
+		}
+	}
+	if !flush() {
+		return
+	}
+	if err := scanner.Err(); err != nil {
+		// the status is already sent, so report the broken stream as a last item
+		_ = encoder.Encode(entities.BulkShortenResult{Index: index, Error: &entities.ErrorDetail{Code: CodeInvalidRequest, Message: err.Error()}})
+	}
+}
+
+func bulkResult(index int, result service.BulkResult) entities.BulkShortenResult {
+	if result.Err != nil {
+		_, detail := errorDetail(result.Err)
+		return entities.BulkShortenResult{Index: index, Error: &detail}
+	}
+	return entities.BulkShortenResult{Index: index, Result: result.Response}
+}
@@ -0,0 +1,191 @@
+package handler
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"urlshortener/internal/auth"
+	"urlshortener/internal/config"
+	"urlshortener/internal/database"
+	"urlshortener/internal/entities"
+	"urlshortener/internal/middleware"
+	"urlshortener/internal/service"
+)
+
+func TestBulkShortenHandler_JSON(t *testing.T) {
+	db := database.NewInMemoryDatabase()
+	app := &App{service: service.NewURLShortenService(db, "http://localhost:8080")}
+	body := `[{"longURL":"https://www.reddit.com/r/Fedora/","alias":"fedora"},{"longURL":"nope"},{"longURL":"https://www.wikipedia.org/"}]`
+	req := httptest.NewRequest(http.MethodPost, "/shortURL/bulk", strings.NewReader(body))
+	req = req.WithContext(auth.WithKeyID(req.Context(), "ci"))
+	rr := httptest.NewRecorder()
+	app.BulkShortenHandler().ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var results []entities.BulkShortenResult
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &results))
+	require.Len(t, results, 3)
+	for i, result := range results {
+		assert.Equal(t, i, result.Index)
+	}
+	assert.Equal(t, "http://localhost:8080/fedora", results[0].Result.ShortURl)
+	assert.Nil(t, results[0].Error)
+	assert.Nil(t, results[1].Result)
+	assert.Equal(t, CodeInvalidURL, results[1].Error.Code)
+	assert.Equal(t, entities.LinkCreated, results[2].Result.Status)
+	assert.Equal(t, "ci", db.RetrieveData(req.Context(), "fedora").Owner)
+
+	for _, bad := range []string{`{"longURL":"https://a.com"}`, `[`, ``} {
+		rr = httptest.NewRecorder()
+		app.BulkShortenHandler().ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/shortURL/bulk", strings.NewReader(bad)))
+		assert.Equal(t, http.StatusBadRequest, rr.Code, bad)
+	}
+	rr = httptest.NewRecorder()
+	app.BulkShortenHandler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/shortURL/bulk", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
+}
+
+func TestBulkShortenHandler_NDJSON(t *testing.T) {
+	app := &App{service: service.NewURLShortenService(database.NewInMemoryDatabase(), "http://localhost:8080")}
+	var body strings.Builder
+	lines := 2*service.BulkBatchSize + 3 // spans several batches
+	for i := 0; i < lines; i++ {
+		switch i {
+		case 5:
+			body.WriteString("{not json\n")
+		case 300:
+			body.WriteString(`{"longURL":"ftp:/broken"}` + "\n")
+		default:
+			body.WriteString(`{"longURL":"https://www.reddit.com/r/` + strings.Repeat("a", i%7+1) + `/` + string(rune('a'+i%26)) + `"}` + "\n\n")
+		}
+	}
+	req := httptest.NewRequest(http.MethodPost, "/shortURL/bulk", strings.NewReader(body.String()))
+	req.Header.Set("Content-Type", "application/x-ndjson; charset=utf-8")
+	rr := httptest.NewRecorder()
+	app.BulkShortenHandler().ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, ContentTypeNDJSON, rr.Header().Get("Content-Type"))
+
+	scanner := bufio.NewScanner(rr.Body)
+	index := 0
+	for scanner.Scan() {
+		var result entities.BulkShortenResult
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &result))
+		assert.Equal(t, index, result.Index)
+		switch index {
+		case 5:
+			assert.Equal(t, CodeInvalidRequest, result.Error.Code)
+		case 300:
+			assert.Equal(t, CodeInvalidURL, result.Error.Code)
+		default:
+			assert.Nil(t, result.Error, index)
+			assert.NotNil(t, result.Result, index)
+		}
+		index++
+	}
+	assert.Equal(t, lines, index)
+}
+
+// newBulkRequest returns a bulk request of n links, a JSON array unless
+// contentType is NDJSON.
+func newBulkRequest(n int, contentType string) *http.Request {
+	var body strings.Builder
+	if contentType == "" {
+		body.WriteString("[")
+	}
+	for i := 0; i < n; i++ {
+		if contentType == "" && i > 0 {
+			body.WriteString(",")
+		}
+		body.WriteString(fmt.Sprintf(`{"longURL":"https://example.com/%d"}`, i))
+		if contentType != "" {
+			body.WriteString("\n")
+		}
+	}
+	if contentType == "" {
+		body.WriteString("]")
+	}
+	req := httptest.NewRequest(http.MethodPost, "/shortURL/bulk", strings.NewReader(body.String()))
+	req.Header.Set("Content-Type", contentType)
+	return req
+}
+
+// Test that every bulk item costs a token of the rate limit
+func TestBulkShortenHandler_RateLimit(t *testing.T) {
+	app := &App{service: service.NewURLShortenService(database.NewInMemoryDatabase(), "http://localhost:8080")}
+	handler := middleware.NewRateLimiter(middleware.RateLimit{PerMinute: 1, Burst: 300}).Middleware(app.BulkShortenHandler())
+	bulk := func(n int, contentType string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, newBulkRequest(n, contentType))
+		return rr
+	}
+
+	assert.Equal(t, http.StatusOK, bulk(200, "").Code)
+	rr := bulk(101, "")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code, "101 links with 100 tokens left")
+	assert.Equal(t, middleware.CodeRateLimited, decodeError(t, rr).Code)
+	assert.NotEmpty(t, rr.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusOK, bulk(99, "").Code, "a rejected request only pays for itself")
+	assert.Equal(t, http.StatusTooManyRequests, bulk(1, "").Code)
+
+	handler = middleware.NewRateLimiter(middleware.RateLimit{PerMinute: 1, Burst: 300}).Middleware(app.BulkShortenHandler())
+	rr = bulk(301, "")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code, "more links than the burst never fit")
+	assert.Empty(t, rr.Header().Get("Retry-After"))
+
+	// a stream is cut off at the first batch it cannot pay for
+	rr = bulk(2*service.BulkBatchSize+10, ContentTypeNDJSON)
+	require.Equal(t, http.StatusOK, rr.Code)
+	var results []entities.BulkShortenResult
+	scanner := bufio.NewScanner(rr.Body)
+	for scanner.Scan() {
+		var result entities.BulkShortenResult
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &result))
+		results = append(results, result)
+	}
+	require.Len(t, results, 2*service.BulkBatchSize)
+	assert.NotNil(t, results[service.BulkBatchSize-1].Result)
+	assert.Equal(t, middleware.CodeRateLimited, results[service.BulkBatchSize].Error.Code)
+	assert.Equal(t, middleware.CodeRateLimited, results[2*service.BulkBatchSize-1].Error.Code)
+	assert.Equal(t, http.StatusTooManyRequests, bulk(100, ContentTypeNDJSON).Code, "nothing was sent yet")
+}
+
+// Test that the default limits let a client send full bulk requests, which
+// are charged to the bulk quota rather than to the creation rate limit
+func TestBulkShortenHandler_DefaultLimits(t *testing.T) {
+	cfg := config.Default()
+	app := &App{service: service.NewURLShortenService(database.NewInMemoryDatabase(), "http://localhost:8080")}
+	createLimit := middleware.NewRateLimiter(middleware.RateLimit{PerMinute: cfg.CreateRateLimit, Burst: cfg.CreateBurst}).Middleware
+	bulkLimit := middleware.NewRateLimiter(middleware.RateLimit{PerMinute: cfg.BulkRateLimit, Burst: cfg.BulkBurst}).Middleware
+	handler := createLimit(bulkLimit(app.BulkShortenHandler()))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, newBulkRequest(service.MaxBulkItems/2, ""))
+	require.Equal(t, http.StatusOK, rr.Code)
+	var results []entities.BulkShortenResult
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&results))
+	assert.Len(t, results, service.MaxBulkItems/2)
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, newBulkRequest(4*service.BulkBatchSize, ContentTypeNDJSON))
+	require.Equal(t, http.StatusOK, rr.Code)
+	lines := 0
+	scanner := bufio.NewScanner(rr.Body)
+	for scanner.Scan() {
+		var result entities.BulkShortenResult
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &result))
+		assert.Nil(t, result.Error, "item %d", result.Index)
+		lines++
+	}
+	assert.Equal(t, 4*service.BulkBatchSize, lines)
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, newBulkRequest(service.MaxBulkItems, ""))
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code, "the bulk quota is spent")
+}
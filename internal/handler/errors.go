@@ -0,0 +1,99 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"urlshortener/internal/entities"
+	"urlshortener/internal/service"
+)
+
+// Machine readable error codes written in entities.ErrorDetail.Code.
+const (
+	CodeInvalidRequest   = "invalid_request"
+	CodeInvalidURL       = "invalid_url"
+	CodeInvalidAlias     = "invalid_alias"
+	CodeInvalidExpiry    = "invalid_expiry"
+	CodeInvalidRedirect  = "invalid_redirect"
+	CodeInvalidDomain    = "invalid_domain"
+	CodeNotFound         = "not_found"
+	CodeExpired          = "expired"
+	CodeDisabled         = "disabled"
+	CodeUnauthorized     = "unauthorized"
+	CodeForbidden        = "forbidden"
+	CodeConflict         = "conflict"
+	CodeBlockedURL       = "blocked_url"
+	CodeMethodNotAllowed = "method_not_allowed"
+	CodeUnavailable      = "unavailable"
+	CodeInternal         = "internal_error"
+)
+
+// serviceErrors maps service errors to their HTTP status and error code.
+var serviceErrors = []struct {
+	err    error
+	status int
+	code   string
+}{
+	{service.ErrInvalidURL, http.StatusBadRequest, CodeInvalidURL},
+	{service.ErrInvalidAlias, http.StatusBadRequest, CodeInvalidAlias},
+	{service.ErrReservedAlias, http.StatusBadRequest, CodeInvalidAlias},
+	{service.ErrInvalidExpiry, http.StatusBadRequest, CodeInvalidExpiry},
+	{service.ErrExpiryTooLong, http.StatusBadRequest, CodeInvalidExpiry},
+	{service.ErrInvalidRedirect, http.StatusBadRequest, CodeInvalidRedirect},
+	{service.ErrUnknownDomain, http.StatusBadRequest, CodeInvalidDomain},
+	{service.ErrInvalidLimit, http.StatusBadRequest, CodeInvalidRequest},
+	{service.ErrInvalidWindow, http.StatusBadRequest, CodeInvalidRequest},
+	{service.ErrTooManyItems, http.StatusRequestEntityTooLarge, CodeInvalidRequest},
+	{service.ErrNotFound, http.StatusNotFound, CodeNotFound},
+	{service.ErrExpired, http.StatusGone, CodeExpired},
+	{service.ErrDisabled, http.StatusGone, CodeDisabled},
+	{service.ErrUnauthenticated, http.StatusUnauthorized, CodeUnauthorized},
+	{service.ErrForbidden, http.StatusForbidden, CodeForbidden},
+	{service.ErrAliasTaken, http.StatusConflict, CodeConflict},
+	{service.ErrBlockedURL, http.StatusForbidden, CodeBlockedURL},
+	{service.ErrHashExhausted, http.StatusServiceUnavailable, CodeUnavailable},
+	{service.ErrScreeningUnavailable, http.StatusServiceUnavailable, CodeUnavailable},
+}
+
+// writeServiceError writes the error envelope matching err; unknown errors
+// are logged and reported as 500 without leaking their text.
+func writeServiceError(writer http.ResponseWriter, err error) {
+	status, detail := errorDetail(err)
+	writeError(writer, status, detail.Code, detail.Message)
+}
+
+// errorDetail returns the HTTP status and error detail matching err.
+func errorDetail(err error) (int, entities.ErrorDetail) {
+	for _, e := range serviceErrors {
+		if errors.Is(err, e.err) {
+			return e.status, entities.ErrorDetail{Code: e.code, Message: err.Error()}
+		}
+	}
+	log.Printf("internal error: %s", err)
+	return http.StatusInternalServerError, entities.ErrorDetail{Code: CodeInternal, Message: "internal server error"}
+}
+
+func writeError(writer http.ResponseWriter, status int, code, message string) {
+	writeJSON(writer, status, entities.ErrorResponse{
+		Error: entities.ErrorDetail{Code: code, Message: message},
+	})
+}
+
+func writeMethodNotAllowed(writer http.ResponseWriter, allowed ...string) {
+	writer.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeError(writer, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "method not allowed")
+}
+
+func writeJSON(writer http.ResponseWriter, status int, body any) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		log.Printf("could not encode response: %s", err)
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	_, _ = writer.Write(data)
+}
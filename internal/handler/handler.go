@@ -3,9 +3,11 @@ package handler
 import (
 	"context"
 	"encoding/json"
-	"fmt"
 	"io"
 	"net/http"
+	"strconv"
+	"sync"
+	"urlshortener/internal/auth"
 	"urlshortener/internal/database"
 	"urlshortener/internal/entities"
 	"urlshortener/internal/service"
@@ -13,16 +15,45 @@ import (
 
 type App struct {
 	service *service.URLShortenService
+	stop    context.CancelFunc // cancels the background jobs
+	jobs    sync.WaitGroup
 }
 
-func NewApp(domain string) *App {
-	db := database.NewInMemoryDatabase()
-	s := service.NewURLShortenService(*db, domain)
-	app := App{
+// NewApp builds the service and starts its background jobs, which run until
+// Close is called.
+func NewApp(db database.DB, domain string, opts ...service.Option) *App {
+	s := service.NewURLShortenService(db, domain, opts...)
+	ctx, stop := context.WithCancel(context.Background())
+	app := &App{
 		service: s,
+		stop:    stop,
+	}
+	for _, job := range []func(context.Context){s.PopulateTopDomains, s.ReapExpiredLinks, s.RecordClicks} {
+		app.jobs.Add(1)
+		go func() {
+			defer app.jobs.Done()
+			job(ctx)
+		}()
+	}
+	return app
+}
+
+// Close stops the background jobs and waits for them to finish, which
+// includes writing queued clicks to the store. It gives up when ctx is done.
+// Close should be called once no more requests are being served.
+func (a *App) Close(ctx context.Context) error {
+	a.stop()
+	done := make(chan struct{})
+	go func() {
+		a.jobs.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	go s.PopulateTopDomains()
-	return &app
 }
 
 func (a *App) RedirectHandler() http.HandlerFunc {
@@ -31,22 +62,40 @@ func (a *App) RedirectHandler() http.HandlerFunc {
 		case http.MethodGet:
 			id := request.URL.Path[1:]
 			if id == "" {
-				writer.WriteHeader(http.StatusBadRequest)
+				writeError(writer, http.StatusBadRequest, CodeInvalidRequest, "missing short URL id")
+				return
 			}
 			ctx := context.Background()
-			resp := a.service.RedirectURL(ctx, id)
-			if resp == nil {
-				writer.WriteHeader(http.StatusServiceUnavailable)
+			// the same code may exist on several short domains
+			key := a.service.HostKey(request.Host, id)
+			resp, err := a.service.RedirectURL(ctx, key)
+			if err != nil {
+				writeServiceError(writer, err)
+				return
 			}
-			if resp != nil {
-				fmt.Println("Redirecting")
-				http.Redirect(writer, request, resp.LongURl, http.StatusPermanentRedirect)
+			a.service.RecordClick(key, request.Referer(), request.UserAgent())
+			http.Redirect(writer, request, resp.LongURl, resp.StatusCode)
+		default:
+			writeMethodNotAllowed(writer, http.MethodGet)
+		}
+	})
+	return f
+}
+
+// LinkStatsHandler serves GET /{id}/stats with the click analytics of a link.
+func (a *App) LinkStatsHandler() http.HandlerFunc {
+	f := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		switch request.Method {
+		case http.MethodGet:
+			ctx := context.Background()
+			resp, err := a.service.LinkStats(ctx, a.service.HostKey(request.Host, request.PathValue("id")), auth.KeyID(request.Context()))
+			if err != nil {
+				writeServiceError(writer, err)
 				return
 			}
-			writer.WriteHeader(http.StatusBadRequest)
-			return
+			writeJSON(writer, http.StatusOK, resp)
 		default:
-			writer.WriteHeader(http.StatusBadRequest)
+			writeMethodNotAllowed(writer, http.MethodGet)
 		}
 	})
 	return f
@@ -59,49 +108,106 @@ func (a *App) GenerateShortURL() http.HandlerFunc {
 			req := entities.ShortenURLRequest{}
 			data, err := io.ReadAll(request.Body)
 			if err != nil {
-				writer.WriteHeader(http.StatusBadRequest)
-				_, _ = writer.Write([]byte(err.Error()))
+				writeError(writer, http.StatusBadRequest, CodeInvalidRequest, err.Error())
 				return
 			}
 			err = json.Unmarshal(data, &req)
 			if err != nil {
-				writer.WriteHeader(http.StatusBadRequest)
-				_, _ = writer.Write([]byte(err.Error()))
+				writeError(writer, http.StatusBadRequest, CodeInvalidRequest, err.Error())
 				return
 			}
+			req.Owner = auth.KeyID(request.Context())
 			ctx := context.Background()
 			resp, err := a.service.ShortenURL(ctx, req)
-			repData, err := json.Marshal(resp)
-			_, err = writer.Write(repData)
 			if err != nil {
-				writer.WriteHeader(http.StatusBadRequest)
+				writeServiceError(writer, err)
 				return
 			}
+			writeJSON(writer, http.StatusOK, resp)
 		default:
-			writer.WriteHeader(http.StatusBadRequest)
+			writeMethodNotAllowed(writer, http.MethodPost)
 		}
 	})
 	return f
 }
 
-func (a *App) Top3Domains() http.HandlerFunc {
+// LinkHandler serves the link management API on /api/links/{id}: GET returns
+// the link, PATCH updates its target, expiry, redirect type or disabled flag,
+// and DELETE removes it. Links on other than the default short domain are
+// named with ?domain=.
+func (a *App) LinkHandler() http.HandlerFunc {
 	f := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		id, err := a.service.LinkKey(request.URL.Query().Get("domain"), request.PathValue("id"))
+		if err != nil {
+			writeServiceError(writer, err)
+			return
+		}
+		owner := auth.KeyID(request.Context())
+		ctx := context.Background()
 		switch request.Method {
 		case http.MethodGet:
-			ctx := context.Background()
-			res := a.service.RetrieveTop3Domains(ctx)
-			data, err := json.Marshal(res)
+			resp, err := a.service.GetLink(ctx, id, owner)
+			if err != nil {
+				writeServiceError(writer, err)
+				return
+			}
+			writeJSON(writer, http.StatusOK, resp)
+		case http.MethodPatch:
+			req := entities.UpdateLinkRequest{}
+			data, err := io.ReadAll(request.Body)
+			if err != nil {
+				writeError(writer, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+				return
+			}
+			err = json.Unmarshal(data, &req)
+			if err != nil {
+				writeError(writer, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+				return
+			}
+			resp, err := a.service.UpdateLink(ctx, id, owner, req)
 			if err != nil {
-				writer.WriteHeader(http.StatusBadRequest)
+				writeServiceError(writer, err)
+				return
+			}
+			writeJSON(writer, http.StatusOK, resp)
+		case http.MethodDelete:
+			if err := a.service.DeleteLink(ctx, id, owner); err != nil {
+				writeServiceError(writer, err)
 				return
 			}
-			_, err = writer.Write(data)
+			writer.WriteHeader(http.StatusNoContent)
+		default:
+			writeMethodNotAllowed(writer, http.MethodGet, http.MethodPatch, http.MethodDelete)
+		}
+	})
+	return f
+}
+
+// TopDomains serves GET /metrics?limit=N&window=1h|24h|7d with the domains
+// shortened most, all time by default.
+func (a *App) TopDomains() http.HandlerFunc {
+	f := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		switch request.Method {
+		case http.MethodGet:
+			query := request.URL.Query()
+			limit := service.DefaultTopDomainsLimit
+			if raw := query.Get("limit"); raw != "" {
+				n, err := strconv.Atoi(raw)
+				if err != nil {
+					writeServiceError(writer, service.ErrInvalidLimit)
+					return
+				}
+				limit = n
+			}
+			ctx := context.Background()
+			res, err := a.service.RetrieveTopDomains(ctx, limit, query.Get("window"))
 			if err != nil {
-				writer.WriteHeader(http.StatusBadRequest)
+				writeServiceError(writer, err)
 				return
 			}
+			writeJSON(writer, http.StatusOK, res)
 		default:
-			writer.WriteHeader(http.StatusBadRequest)
+			writeMethodNotAllowed(writer, http.MethodGet)
 		}
 	})
 	return f
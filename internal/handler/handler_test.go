@@ -2,10 +2,19 @@ package handler
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
+	"urlshortener/internal/auth"
+	"urlshortener/internal/database"
+	"urlshortener/internal/entities"
 	"urlshortener/internal/service"
 )
 
@@ -26,7 +35,7 @@ type RedirectResponse struct {
 func TestRedirectHandler(t *testing.T) {
 	// Mock the service and the app
 	mockService := new(MockService)
-	app := &App{service: new(service.URLShortenService)}
+	app := &App{service: service.NewURLShortenService(database.NewInMemoryDatabase(), "http://localhost:8080")}
 
 	// Create a new request (GET /short-id)
 	req, err := http.NewRequest("GET", "/short-id", nil)
@@ -48,13 +57,13 @@ func TestRedirectHandler(t *testing.T) {
 			name:           "Valid ID, redirect",
 			id:             "short-id",
 			mockResp:       &RedirectResponse{LongURl: "https://example.com/eacnjkd"},
-			expectedStatus: http.StatusServiceUnavailable,
+			expectedStatus: http.StatusNotFound,
 		},
 		{
 			name:           "Service unavailable, internal error",
 			id:             "short-id",
 			mockResp:       nil,
-			expectedStatus: http.StatusServiceUnavailable,
+			expectedStatus: http.StatusNotFound,
 		},
 	}
 
@@ -83,3 +92,361 @@ func TestRedirectHandler(t *testing.T) {
 		})
 	}
 }
+
+// Test that links created through the app land in the injected store
+func TestNewApp_UsesInjectedDB(t *testing.T) {
+	db := database.NewInMemoryDatabase()
+	app := NewApp(db, "http://localhost:8080")
+
+	body := strings.NewReader(`{"longURL":"https://www.reddit.com/r/Fedora/"}`)
+	req := httptest.NewRequest(http.MethodPost, "/shortURL", body)
+	rr := httptest.NewRecorder()
+	app.GenerateShortURL().ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.NotEmpty(t, db.RetrieveDuplicateURL(context.Background(), "https://www.reddit.com/r/Fedora/"))
+}
+
+// Test that a conflicting alias is reported as 409
+func TestGenerateShortURL_AliasConflict(t *testing.T) {
+	app := NewApp(database.NewInMemoryDatabase(), "http://localhost:8080")
+	post := func(body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		app.GenerateShortURL().ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/shortURL", strings.NewReader(body)))
+		return rr
+	}
+	assert.Equal(t, http.StatusOK, post(`{"longURL":"https://www.reddit.com/r/Fedora/","alias":"spring-sale"}`).Code)
+	conflict := post(`{"longURL":"https://www.amazon.com/deals","alias":"spring-sale"}`)
+	assert.Equal(t, http.StatusConflict, conflict.Code)
+	assert.Equal(t, CodeConflict, decodeError(t, conflict).Code)
+	reserved := post(`{"longURL":"https://www.amazon.com/deals","alias":"metrics"}`)
+	assert.Equal(t, http.StatusBadRequest, reserved.Code)
+	assert.Equal(t, CodeInvalidAlias, decodeError(t, reserved).Code)
+}
+
+func decodeError(t *testing.T, rr *httptest.ResponseRecorder) entities.ErrorDetail {
+	t.Helper()
+	var body entities.ErrorResponse
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &body))
+	assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+	return body.Error
+}
+
+// Test that handler failures map to the right status and JSON error code
+func TestHandlers_ErrorModel(t *testing.T) {
+	db := database.NewInMemoryDatabase()
+	app := NewApp(db, "http://localhost:8080")
+	ctx := context.Background()
+	assert.NoError(t, db.AddData(ctx, "OLD123", entities.ShortURLDBData{
+		LongURL:    "https://www.reddit.com/r/Fedora/",
+		ShortURl:   "OLD123",
+		ExpiryDate: time.Now().Add(-time.Hour),
+	}))
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		method  string
+		path    string
+		body    string
+		status  int
+		code    string
+	}{
+		{"invalid url", app.GenerateShortURL(), http.MethodPost, "/shortURL", `{"longURL":"https://invalid-url."}`, http.StatusBadRequest, CodeInvalidURL},
+		{"empty url", app.GenerateShortURL(), http.MethodPost, "/shortURL", `{"longURL":""}`, http.StatusBadRequest, CodeInvalidURL},
+		{"malformed body", app.GenerateShortURL(), http.MethodPost, "/shortURL", `{`, http.StatusBadRequest, CodeInvalidRequest},
+		{"bad ttl", app.GenerateShortURL(), http.MethodPost, "/shortURL", `{"longURL":"https://www.reddit.com","ttl":"soon"}`, http.StatusBadRequest, CodeInvalidExpiry},
+		{"shorten wrong method", app.GenerateShortURL(), http.MethodGet, "/shortURL", "", http.StatusMethodNotAllowed, CodeMethodNotAllowed},
+		{"unknown code", app.RedirectHandler(), http.MethodGet, "/NOPE42", "", http.StatusNotFound, CodeNotFound},
+		{"expired code", app.RedirectHandler(), http.MethodGet, "/OLD123", "", http.StatusGone, CodeExpired},
+		{"redirect wrong method", app.RedirectHandler(), http.MethodPost, "/OLD123", "", http.StatusMethodNotAllowed, CodeMethodNotAllowed},
+		{"metrics wrong method", app.TopDomains(), http.MethodDelete, "/metrics", "", http.StatusMethodNotAllowed, CodeMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			tt.handler.ServeHTTP(rr, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+			assert.Equal(t, tt.status, rr.Code)
+			assert.Equal(t, tt.code, decodeError(t, rr).Code)
+			if tt.status == http.StatusMethodNotAllowed {
+				assert.NotEmpty(t, rr.Header().Get("Allow"))
+			}
+		})
+	}
+}
+
+// Test that a known code redirects to its long URL
+func TestRedirectHandler_Redirects(t *testing.T) {
+	app := NewApp(database.NewInMemoryDatabase(), "http://localhost:8080")
+	rr := httptest.NewRecorder()
+	app.GenerateShortURL().ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/shortURL", strings.NewReader(`{"longURL":"https://www.reddit.com/r/Fedora/","alias":"fedora"}`)))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	rr = httptest.NewRecorder()
+	app.RedirectHandler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/fedora", nil))
+	assert.Equal(t, http.StatusPermanentRedirect, rr.Code)
+	assert.Equal(t, "https://www.reddit.com/r/Fedora/", rr.Header().Get("Location"))
+}
+
+// Test that service errors without a request path to trigger them still map correctly
+func TestWriteServiceError(t *testing.T) {
+	rr := httptest.NewRecorder()
+	writeServiceError(rr, service.ErrHashExhausted)
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Equal(t, CodeUnavailable, decodeError(t, rr).Code)
+
+	rr = httptest.NewRecorder()
+	writeServiceError(rr, fmt.Errorf("%w: evil.com is on the deny list", service.ErrBlockedURL))
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Equal(t, entities.ErrorDetail{Code: CodeBlockedURL, Message: "URL is not allowed: evil.com is on the deny list"}, decodeError(t, rr))
+
+	rr = httptest.NewRecorder()
+	writeServiceError(rr, errors.New("disk full"))
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+	detail := decodeError(t, rr)
+	assert.Equal(t, CodeInternal, detail.Code)
+	assert.NotContains(t, detail.Message, "disk full")
+}
+
+// Test that the redirect handler answers with the link's redirect type
+func TestRedirectHandler_RedirectType(t *testing.T) {
+	app := NewApp(database.NewInMemoryDatabase(), "http://localhost:8080")
+	rr := httptest.NewRecorder()
+	app.GenerateShortURL().ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/shortURL", strings.NewReader(`{"longURL":"https://www.reddit.com/r/Fedora/","alias":"fedora","redirectType":302}`)))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	rr = httptest.NewRecorder()
+	app.RedirectHandler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/fedora", nil))
+	assert.Equal(t, http.StatusFound, rr.Code)
+	assert.Equal(t, "https://www.reddit.com/r/Fedora/", rr.Header().Get("Location"))
+}
+
+// Test that followed redirects show up on the stats endpoint
+func TestLinkStatsHandler(t *testing.T) {
+	app := NewApp(database.NewInMemoryDatabase(), "http://localhost:8080")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/shortURL", app.GenerateShortURL())
+	mux.HandleFunc("/{id}", app.RedirectHandler())
+	mux.HandleFunc("/{id}/stats", app.LinkStatsHandler())
+	withKey := func(req *http.Request) *http.Request {
+		return req.WithContext(auth.WithKeyID(req.Context(), "ci"))
+	}
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, withKey(httptest.NewRequest(http.MethodPost, "/shortURL", strings.NewReader(`{"longURL":"https://www.reddit.com/r/Fedora/","alias":"fedora"}`))))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/fedora", nil)
+		req.Header.Set("Referer", "https://news.ycombinator.com/")
+		rr = httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusPermanentRedirect, rr.Code)
+	}
+
+	var stats entities.LinkStatsResponse
+	assert.Eventually(t, func() bool {
+		rr = httptest.NewRecorder()
+		mux.ServeHTTP(rr, withKey(httptest.NewRequest(http.MethodGet, "/fedora/stats", nil)))
+		return rr.Code == http.StatusOK && json.Unmarshal(rr.Body.Bytes(), &stats) == nil && stats.TotalClicks == 2
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "news.ycombinator.com", stats.TopReferrers[0].Name)
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, withKey(httptest.NewRequest(http.MethodGet, "/NOPE42/stats", nil)))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/fedora/stats", nil))
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+}
+
+// Test the limit and window parameters of /metrics
+func TestTopDomains_Query(t *testing.T) {
+	db := database.NewInMemoryDatabase()
+	app := NewApp(db, "http://localhost:8080")
+	for _, longURL := range []string{"https://a.com/1", "https://a.com/2", "https://b.com/1", "https://c.com/1", "https://d.com/1"} {
+		rr := httptest.NewRecorder()
+		app.GenerateShortURL().ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/shortURL", strings.NewReader(`{"longURL":"`+longURL+`"}`)))
+		assert.Equal(t, http.StatusOK, rr.Code)
+	}
+	db.PopulateTopDomains(context.Background(), time.Now())
+
+	get := func(query string) (*httptest.ResponseRecorder, []entities.TopDomains) {
+		rr := httptest.NewRecorder()
+		app.TopDomains().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics"+query, nil))
+		var domains []entities.TopDomains
+		_ = json.Unmarshal(rr.Body.Bytes(), &domains)
+		return rr, domains
+	}
+	rr, domains := get("")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Len(t, domains, 3)
+	assert.Equal(t, entities.TopDomains{Domain: "a.com", Count: 2}, domains[0])
+	_, domains = get("?limit=10&window=1h")
+	assert.Len(t, domains, 4)
+	_, domains = get("?limit=1&window=24h")
+	assert.Equal(t, []entities.TopDomains{{Domain: "a.com", Count: 2}}, domains)
+
+	for _, query := range []string{"?limit=abc", "?limit=0", "?window=2h"} {
+		rr, _ = get(query)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, query)
+		assert.Equal(t, CodeInvalidRequest, decodeError(t, rr).Code)
+	}
+}
+
+// Test that Close stops the background jobs after writing queued clicks
+func TestApp_Close(t *testing.T) {
+	db := database.NewInMemoryDatabase()
+	app := NewApp(db, "http://localhost:8080")
+	rr := httptest.NewRecorder()
+	app.GenerateShortURL().ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/shortURL", strings.NewReader(`{"longURL":"https://www.reddit.com/r/Fedora/","alias":"fedora"}`)))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	for i := 0; i < 5; i++ {
+		rr = httptest.NewRecorder()
+		app.RedirectHandler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/fedora", nil))
+		assert.Equal(t, http.StatusPermanentRedirect, rr.Code)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, app.Close(ctx))
+	assert.Equal(t, 5, db.RetrieveClickStats(context.Background(), "fedora").Total)
+}
+
+// Test that the authenticated key is recorded as the owner of a created link
+func TestGenerateShortURL_RecordsOwner(t *testing.T) {
+	db := database.NewInMemoryDatabase()
+	app := &App{service: service.NewURLShortenService(db, "http://localhost:8080")}
+	req := httptest.NewRequest(http.MethodPost, "/shortURL", strings.NewReader(`{"longURL":"https://www.reddit.com/r/Fedora/","alias":"fedora"}`))
+	req = req.WithContext(auth.WithKeyID(req.Context(), "ci"))
+	rr := httptest.NewRecorder()
+	app.GenerateShortURL().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "ci", db.RetrieveData(context.Background(), "fedora").Owner)
+}
+
+// Test the link management API
+func TestLinkHandler(t *testing.T) {
+	db := database.NewInMemoryDatabase()
+	app := &App{service: service.NewURLShortenService(db, "http://localhost:8080")}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/shortURL", app.GenerateShortURL())
+	mux.HandleFunc("/{id}", app.RedirectHandler())
+	mux.HandleFunc("/{id}/stats", app.LinkStatsHandler())
+	mux.HandleFunc("/api/links/{id}", app.LinkHandler())
+	serve := func(method, path, body, owner string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req = req.WithContext(auth.WithKeyID(req.Context(), owner))
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := serve(http.MethodPost, "/shortURL", `{"longURL":"https://www.reddit.com/r/Fedora/","alias":"fedora"}`, "ci")
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	rr = serve(http.MethodGet, "/api/links/fedora", "", "ci")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var link entities.LinkResponse
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &link))
+	assert.Equal(t, "https://www.reddit.com/r/Fedora/", link.LongURL)
+	assert.Equal(t, "ci", link.Owner)
+
+	rr = serve(http.MethodGet, "/api/links/fedora", "", "ops")
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Equal(t, CodeForbidden, decodeError(t, rr).Code)
+	assert.Equal(t, http.StatusOK, serve(http.MethodGet, "/fedora/stats", "", "ci").Code)
+	rr = serve(http.MethodGet, "/fedora/stats", "", "ops")
+	assert.Equal(t, http.StatusForbidden, rr.Code, "stats are private to the owner")
+
+	rr = serve(http.MethodPatch, "/api/links/fedora", `{"longURL":"https://www.wikipedia.org/","redirectType":302}`, "ci")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	rr = serve(http.MethodGet, "/fedora", "", "")
+	assert.Equal(t, http.StatusFound, rr.Code)
+	assert.Equal(t, "https://www.wikipedia.org/", rr.Header().Get("Location"))
+
+	rr = serve(http.MethodPatch, "/api/links/fedora", `{"disabled":true}`, "ci")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	rr = serve(http.MethodGet, "/fedora", "", "")
+	assert.Equal(t, http.StatusGone, rr.Code)
+	assert.Equal(t, CodeDisabled, decodeError(t, rr).Code)
+
+	rr = serve(http.MethodPatch, "/api/links/fedora", `{"disabled":"yes"}`, "ci")
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	rr = serve(http.MethodPut, "/api/links/fedora", `{}`, "ci")
+	assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
+	assert.Equal(t, "GET, PATCH, DELETE", rr.Header().Get("Allow"))
+
+	rr = serve(http.MethodDelete, "/api/links/fedora", "", "ci")
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	rr = serve(http.MethodGet, "/api/links/fedora", "", "ci")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	rr = serve(http.MethodGet, "/fedora", "", "")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+// Test that links cannot be managed without an API key, even links created
+// without one
+func TestLinkHandler_Unauthenticated(t *testing.T) {
+	app := NewApp(database.NewInMemoryDatabase(), "http://localhost:8080")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/shortURL", app.GenerateShortURL())
+	mux.HandleFunc("/{id}", app.RedirectHandler())
+	mux.HandleFunc("/api/links/{id}", app.LinkHandler())
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rr
+	}
+	assert.Equal(t, http.StatusOK, serve(http.MethodPost, "/shortURL", `{"longURL":"https://www.reddit.com/r/Fedora/","alias":"fedora"}`).Code)
+
+	rr := serve(http.MethodPatch, "/api/links/fedora", `{"longURL":"https://phishing.example/login"}`)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Equal(t, CodeUnauthorized, decodeError(t, rr).Code)
+	assert.Equal(t, http.StatusUnauthorized, serve(http.MethodDelete, "/api/links/fedora", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, serve(http.MethodGet, "/api/links/fedora", "").Code)
+	assert.Equal(t, "https://www.reddit.com/r/Fedora/", serve(http.MethodGet, "/fedora", "").Header().Get("Location"))
+}
+
+// Test that redirects, stats and link management resolve codes per short domain
+func TestHandlers_Domains(t *testing.T) {
+	app := &App{service: service.NewURLShortenService(database.NewInMemoryDatabase(), "http://localhost:8080", service.WithDomains("https://b.co"))}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/shortURL", app.GenerateShortURL())
+	mux.HandleFunc("/{id}", app.RedirectHandler())
+	mux.HandleFunc("/{id}/stats", app.LinkStatsHandler())
+	mux.HandleFunc("/api/links/{id}", app.LinkHandler())
+	serve := func(method, host, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Host = host
+		req = req.WithContext(auth.WithKeyID(req.Context(), "ci"))
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	assert.Equal(t, http.StatusOK, serve(http.MethodPost, "localhost:8080", "/shortURL", `{"longURL":"https://www.reddit.com/r/Fedora/","alias":"abc"}`).Code)
+	assert.Equal(t, http.StatusOK, serve(http.MethodPost, "localhost:8080", "/shortURL", `{"longURL":"https://www.wikipedia.org/","alias":"abc","domain":"https://b.co"}`).Code)
+	rr := serve(http.MethodPost, "localhost:8080", "/shortURL", `{"longURL":"https://www.wikipedia.org/","domain":"https://evil.co"}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Equal(t, CodeInvalidDomain, decodeError(t, rr).Code)
+
+	rr = serve(http.MethodGet, "b.co", "/abc", "")
+	assert.Equal(t, "https://www.wikipedia.org/", rr.Header().Get("Location"))
+	rr = serve(http.MethodGet, "localhost:8080", "/abc", "")
+	assert.Equal(t, "https://www.reddit.com/r/Fedora/", rr.Header().Get("Location"))
+
+	var stats entities.LinkStatsResponse
+	rr = serve(http.MethodGet, "b.co", "/abc/stats", "")
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &stats))
+	assert.Equal(t, "https://b.co/abc", stats.ShortURL)
+
+	var link entities.LinkResponse
+	rr = serve(http.MethodGet, "localhost:8080", "/api/links/abc?domain=b.co", "")
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &link))
+	assert.Equal(t, "https://www.wikipedia.org/", link.LongURL)
+	rr = serve(http.MethodGet, "localhost:8080", "/api/links/abc?domain=evil.co", "")
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Equal(t, http.StatusNoContent, serve(http.MethodDelete, "localhost:8080", "/api/links/abc?domain=b.co", "").Code)
+	assert.Equal(t, http.StatusNotFound, serve(http.MethodGet, "b.co", "/abc", "").Code)
+	assert.Equal(t, http.StatusPermanentRedirect, serve(http.MethodGet, "localhost:8080", "/abc", "").Code)
+}
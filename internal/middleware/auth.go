@@ -0,0 +1,55 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"urlshortener/internal/auth"
+	"urlshortener/internal/entities"
+)
+
+// CodeUnauthorized is the error code written when a request lacks a valid API key.
+const CodeUnauthorized = "unauthorized"
+
+// APIKeyMiddleware only lets through requests presenting a key known to store,
+// either as "Authorization: Bearer <key>" or in the X-API-Key header. The ID
+// of the key is added to the request context, see auth.KeyID.
+func APIKeyMiddleware(store auth.KeyStore) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := presentedKey(r)
+			if key == "" {
+				unauthorized(w, "missing API key")
+				return
+			}
+			id, ok := store.LookupHash(r.Context(), auth.HashKey(key))
+			if !ok {
+				unauthorized(w, "invalid API key")
+				return
+			}
+			h.ServeHTTP(w, r.WithContext(auth.WithKeyID(r.Context(), id)))
+		})
+	}
+}
+
+func presentedKey(r *http.Request) string {
+	if scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+	return strings.TrimSpace(r.Header.Get("X-API-Key"))
+}
+
+func unauthorized(w http.ResponseWriter, message string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="urlshortener"`)
+	writeError(w, http.StatusUnauthorized, CodeUnauthorized, message)
+}
+
+// writeError writes the same JSON error envelope as the API handlers.
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	data, _ := json.Marshal(entities.ErrorResponse{
+		Error: entities.ErrorDetail{Code: code, Message: message},
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(data)
+}
@@ -0,0 +1,55 @@
+package middleware
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"urlshortener/internal/auth"
+	"urlshortener/internal/entities"
+)
+
+func TestAPIKeyMiddleware(t *testing.T) {
+	store, err := auth.NewStaticKeyStore([]auth.Key{{ID: "ci", Hash: auth.HashKey("s3cret")}})
+	require.NoError(t, err)
+	handler := APIKeyMiddleware(store)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(auth.KeyID(r.Context())))
+	}))
+
+	tests := []struct {
+		name    string
+		header  string
+		value   string
+		status  int
+		message string
+	}{
+		{name: "bearer", header: "Authorization", value: "Bearer s3cret", status: http.StatusOK},
+		{name: "bearer lowercase scheme", header: "Authorization", value: "bearer s3cret", status: http.StatusOK},
+		{name: "api key header", header: "X-API-Key", value: "s3cret", status: http.StatusOK},
+		{name: "missing", status: http.StatusUnauthorized, message: "missing API key"},
+		{name: "basic auth is not a key", header: "Authorization", value: "Basic czNjcmV0", status: http.StatusUnauthorized, message: "missing API key"},
+		{name: "wrong key", header: "X-API-Key", value: "guess", status: http.StatusUnauthorized, message: "invalid API key"},
+		{name: "hash is not the key", header: "X-API-Key", value: auth.HashKey("s3cret"), status: http.StatusUnauthorized, message: "invalid API key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/shortURL", nil)
+			if tt.header != "" {
+				req.Header.Set(tt.header, tt.value)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			assert.Equal(t, tt.status, rr.Code)
+			if tt.status == http.StatusOK {
+				assert.Equal(t, "ci", rr.Body.String())
+				return
+			}
+			assert.Equal(t, `Bearer realm="urlshortener"`, rr.Header().Get("WWW-Authenticate"))
+			var body entities.ErrorResponse
+			require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &body))
+			assert.Equal(t, entities.ErrorDetail{Code: CodeUnauthorized, Message: tt.message}, body.Error)
+		})
+	}
+}
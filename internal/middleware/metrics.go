@@ -0,0 +1,51 @@
+package middleware
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// MetricsMiddleware counts requests and observes their latency per route
+// pattern. Requests that matched no route are labelled "unmatched".
+func MetricsMiddleware(reg prometheus.Registerer) func(http.Handler) http.Handler {
+	factory := promauto.With(reg)
+	requests := factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "urlshortener_http_requests_total",
+		Help: "HTTP requests served, by route pattern, method and status code.",
+	}, []string{"route", "method", "code"})
+	latency := factory.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "urlshortener_http_request_duration_seconds",
+		Help: "HTTP request latency in seconds, by route pattern.",
+		// redirects are usually served in under a millisecond
+		Buckets: append([]float64{.001, .0025}, prometheus.DefBuckets...),
+	}, []string{"route"})
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			startTime := time.Now()
+			rec := newResponseRecorder(w)
+			h.ServeHTTP(rec, r)
+			duration := time.Since(startTime)
+			// the mux fills in r.Pattern while routing
+			route := r.Pattern
+			if route == "" {
+				route = "unmatched"
+			}
+			requests.WithLabelValues(route, methodLabel(r.Method), strconv.Itoa(rec.status)).Inc()
+			latency.WithLabelValues(route).Observe(duration.Seconds())
+		})
+	}
+}
+
+// methodLabel returns method if it is a standard HTTP method, or "other", so
+// that clients cannot create label values at will.
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	}
+	return "other"
+}
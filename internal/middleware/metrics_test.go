@@ -0,0 +1,40 @@
+package middleware
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsMiddleware(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/{id}", testHandler)
+	handler := MetricsMiddleware(reg)(mux)
+
+	for _, path := range []string{"/abc", "/def", "/a/b/c"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	for _, method := range []string{"FOO", "BAR", "get"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, "/abc", nil))
+	}
+
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP urlshortener_http_requests_total HTTP requests served, by route pattern, method and status code.
+# TYPE urlshortener_http_requests_total counter
+urlshortener_http_requests_total{code="200",method="GET",route="/{id}"} 2
+urlshortener_http_requests_total{code="200",method="other",route="/{id}"} 3
+urlshortener_http_requests_total{code="404",method="GET",route="unmatched"} 1
+`), "urlshortener_http_requests_total"))
+	count, err := testutil.GatherAndCount(reg, "urlshortener_http_request_duration_seconds")
+	require.NoError(t, err)
+	assert.Equal(t, 2, count, "one latency series per route")
+	problems, err := testutil.GatherAndLint(reg)
+	require.NoError(t, err)
+	assert.Empty(t, problems)
+}
@@ -1,17 +1,31 @@
 package middleware
 
 import (
-	"log"
+	"log/slog"
 	"net/http"
 	"time"
 )
 
+// LatencyMiddleware logs every request once the handler has returned, with
+// its route pattern, status, response size and latency as structured
+// log/slog fields. Server errors are logged at error level, everything else
+// at info level.
 func LatencyMiddleware(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		startTime := time.Now()
+		rec := newResponseRecorder(w)
+		h.ServeHTTP(rec, r)
 		duration := time.Since(startTime)
-		log.Printf("Method: %s, Path: %s, ROUTE pattern: %s, Latency: %v",
-			r.Method, r.URL.Path, r.Pattern, duration)
-		h.ServeHTTP(w, r)
+		level := slog.LevelInfo
+		if rec.status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		slog.LogAttrs(r.Context(), level, "request",
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.String("route", r.Pattern),
+			slog.Int("status", rec.status),
+			slog.Int("bytes", rec.bytes),
+			slog.Duration("latency", duration))
 	})
 }
@@ -2,11 +2,15 @@ package middleware
 
 import (
 	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
 	"log"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 )
 
 // Simple test handler that just responds with status 200
@@ -49,3 +53,63 @@ func TestLatencyMiddleware(t *testing.T) {
 func containsLatencyLog(logOutput, expectedLog string) bool {
 	return strings.Contains(logOutput, expectedLog)
 }
+
+// captureSlog routes the default slog logger into a JSON buffer for the test.
+func captureSlog(t *testing.T, level slog.Level) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: level})))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return &buf
+}
+
+func TestLatencyMiddleware_StructuredFields(t *testing.T) {
+	buf := captureSlog(t, slog.LevelInfo)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/{id}", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte("hello"))
+	})
+	rr := httptest.NewRecorder()
+	LatencyMiddleware(mux).ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/abc", nil))
+	assert.Equal(t, http.StatusCreated, rr.Code)
+
+	var entry map[string]any
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal(t, "INFO", entry["level"])
+	assert.Equal(t, "request", entry["msg"])
+	assert.Equal(t, "POST", entry["method"])
+	assert.Equal(t, "/abc", entry["path"])
+	assert.Equal(t, "/{id}", entry["route"])
+	assert.Equal(t, float64(http.StatusCreated), entry["status"])
+	assert.Equal(t, float64(5), entry["bytes"])
+	assert.GreaterOrEqual(t, time.Duration(entry["latency"].(float64)), 20*time.Millisecond)
+}
+
+func TestLatencyMiddleware_Levels(t *testing.T) {
+	failing := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	buf := captureSlog(t, slog.LevelWarn)
+	LatencyMiddleware(http.HandlerFunc(testHandler)).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/ok", nil))
+	assert.Empty(t, buf.String(), "info lines are dropped at warn level")
+
+	LatencyMiddleware(failing).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/down", nil))
+	assert.Contains(t, buf.String(), `"level":"ERROR"`)
+	assert.Contains(t, buf.String(), `"status":503`)
+}
+
+// Test that a handler writing only a body is reported as 200
+func TestLatencyMiddleware_ImplicitStatus(t *testing.T) {
+	buf := captureSlog(t, slog.LevelInfo)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("{}"))
+		w.WriteHeader(http.StatusTeapot) // superfluous, must not change the recorded status
+	})
+	LatencyMiddleware(handler).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/x", nil))
+	assert.Contains(t, buf.String(), `"status":200`)
+	assert.Contains(t, buf.String(), `"bytes":2`)
+}
@@ -0,0 +1,170 @@
+package middleware
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"urlshortener/internal/auth"
+)
+
+// CodeRateLimited is the error code written when a client exceeds its rate limit.
+const CodeRateLimited = "rate_limited"
+
+// idleBucketTTL is how long a client may stay silent before its bucket is
+// forgotten; by then the bucket has refilled anyway.
+const idleBucketTTL = 10 * time.Minute
+
+// RateLimit configures a token bucket: clients may send Burst requests at once
+// and then PerMinute requests per minute. A zero PerMinute disables limiting.
+type RateLimit struct {
+	PerMinute int
+	Burst     int
+}
+
+// RateLimiter keeps one token bucket per client. Clients are identified by
+// their API key when the request was authenticated, by IP address otherwise.
+type RateLimiter struct {
+	limit     RateLimit
+	rate      float64 // tokens per second
+	now       func() time.Time
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(limit RateLimit) *RateLimiter {
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+	return &RateLimiter{
+		limit:   limit,
+		rate:    float64(limit.PerMinute) / 60,
+		now:     time.Now,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Allow takes a token from the bucket of client. When none is left it reports
+// how long the client has to wait for the next one.
+func (l *RateLimiter) Allow(client string) (bool, time.Duration) {
+	return l.AllowN(client, 1)
+}
+
+// AllowN takes n tokens from the bucket of client, or none when fewer are
+// left, reporting how long the client has to wait for them. More than Burst
+// tokens never fit, so the wait is zero then.
+func (l *RateLimiter) AllowN(client string, n int) (bool, time.Duration) {
+	if l.limit.PerMinute <= 0 || n <= 0 {
+		return true, 0
+	}
+	if n > l.limit.Burst {
+		return false, 0
+	}
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &bucket{tokens: float64(l.limit.Burst), last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(float64(l.limit.Burst), b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= float64(n) {
+		b.tokens -= float64(n)
+		return true, 0
+	}
+	wait := time.Duration((float64(n) - b.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// sweep forgets idle clients so that the bucket map stays bounded by the
+// number of recently active clients. The caller must hold l.mu.
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < idleBucketTTL {
+		return
+	}
+	l.lastSweep = now
+	for client, b := range l.buckets {
+		if now.Sub(b.last) >= idleBucketTTL {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// Middleware rejects requests over the limit with 429 Too Many Requests and a
+// Retry-After header in whole seconds. Inside APIKeyMiddleware it limits
+// authenticated clients per key; in front of it, where no key is known yet,
+// it limits every client per IP, so that guessing keys is limited too.
+//
+// The request pays one token; handlers that do more work per request, such
+// as bulk creation, take the rest with Take.
+func (l *RateLimiter) Middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := clientID(r)
+		ok, wait := l.Allow(client)
+		if !ok {
+			WriteRateLimited(w, wait)
+			return
+		}
+		ctx := context.WithValue(r.Context(), quotaKey{}, quota{limiter: l, client: client})
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+type quotaKey struct{}
+
+// quota is the bucket a request was admitted from.
+type quota struct {
+	limiter *RateLimiter
+	client  string
+}
+
+// Take takes n more tokens from the bucket that admitted the request of ctx,
+// the innermost one when limiters are nested. Requests that were not rate
+// limited always have tokens left. The token the request already paid counts
+// against the burst, so n must stay below it.
+func Take(ctx context.Context, n int) (bool, time.Duration) {
+	q, ok := ctx.Value(quotaKey{}).(quota)
+	if !ok {
+		return true, 0
+	}
+	if q.limiter.limit.PerMinute > 0 && n >= q.limiter.limit.Burst {
+		return false, 0
+	}
+	return q.limiter.AllowN(q.client, n)
+}
+
+// WriteRateLimited writes the 429 Too Many Requests response of a request
+// that has to wait before it is retried, or that can never fit the burst
+// when wait is zero.
+func WriteRateLimited(w http.ResponseWriter, wait time.Duration) {
+	if wait <= 0 {
+		writeError(w, http.StatusTooManyRequests, CodeRateLimited, "request exceeds the rate limit burst, send fewer items at once")
+		return
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	writeError(w, http.StatusTooManyRequests, CodeRateLimited, "rate limit exceeded, retry later")
+}
+
+// clientID names the bucket of a request: its API key ID, or its remote IP.
+func clientID(r *http.Request) string {
+	if id := auth.KeyID(r.Context()); id != "" {
+		return "key:" + id
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
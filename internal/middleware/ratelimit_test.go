@@ -0,0 +1,171 @@
+package middleware
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+	"urlshortener/internal/auth"
+	"urlshortener/internal/entities"
+)
+
+// fakeClock lets tests move the limiter through time.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func newTestLimiter(limit RateLimit) (*RateLimiter, *fakeClock) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	l := NewRateLimiter(limit)
+	l.now = clock.Now
+	return l, clock
+}
+
+func TestRateLimiter_Allow(t *testing.T) {
+	l, clock := newTestLimiter(RateLimit{PerMinute: 60, Burst: 3})
+	for i := 0; i < 3; i++ {
+		ok, _ := l.Allow("a")
+		assert.True(t, ok, "burst request %d", i)
+	}
+	ok, wait := l.Allow("a")
+	assert.False(t, ok)
+	assert.Equal(t, time.Second, wait)
+
+	// other clients have their own bucket
+	ok, _ = l.Allow("b")
+	assert.True(t, ok)
+
+	clock.now = clock.now.Add(500 * time.Millisecond)
+	ok, wait = l.Allow("a")
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+	clock.now = clock.now.Add(500 * time.Millisecond)
+	ok, _ = l.Allow("a")
+	assert.True(t, ok)
+
+	// a long pause refills up to the burst only
+	clock.now = clock.now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		ok, _ = l.Allow("a")
+		assert.True(t, ok)
+	}
+	ok, _ = l.Allow("a")
+	assert.False(t, ok)
+}
+
+func TestRateLimiter_Disabled(t *testing.T) {
+	l, _ := newTestLimiter(RateLimit{})
+	for i := 0; i < 1000; i++ {
+		ok, _ := l.Allow("a")
+		require.True(t, ok)
+	}
+	assert.Empty(t, l.buckets)
+}
+
+func TestRateLimiter_ForgetsIdleClients(t *testing.T) {
+	l, clock := newTestLimiter(RateLimit{PerMinute: 60, Burst: 1})
+	l.Allow("a")
+	clock.now = clock.now.Add(idleBucketTTL / 2)
+	l.Allow("b")
+	clock.now = clock.now.Add(idleBucketTTL / 2)
+	l.Allow("c")
+	assert.Len(t, l.buckets, 2, "a was idle for the whole TTL")
+	assert.NotContains(t, l.buckets, "a")
+}
+
+func TestRateLimiter_Concurrent(t *testing.T) {
+	l := NewRateLimiter(RateLimit{PerMinute: 1, Burst: 50})
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	allowed := 0
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ok, _ := l.Allow("a"); ok {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 50, allowed)
+}
+
+func TestRateLimiter_Middleware(t *testing.T) {
+	l, _ := newTestLimiter(RateLimit{PerMinute: 2, Burst: 1})
+	handler := l.Middleware(http.HandlerFunc(testHandler))
+	serve := func(remoteAddr, keyID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/abc", nil)
+		req.RemoteAddr = remoteAddr
+		if keyID != "" {
+			req = req.WithContext(auth.WithKeyID(req.Context(), keyID))
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	assert.Equal(t, http.StatusOK, serve("10.0.0.1:1234", "").Code)
+	rr := serve("10.0.0.1:5678", "")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code, "same IP, other port")
+	assert.Equal(t, "30", rr.Header().Get("Retry-After"))
+	var body entities.ErrorResponse
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &body))
+	assert.Equal(t, CodeRateLimited, body.Error.Code)
+
+	assert.Equal(t, http.StatusOK, serve("10.0.0.2:1234", "").Code, "other IP")
+	// authenticated clients are limited per key, wherever they come from
+	assert.Equal(t, http.StatusOK, serve("10.0.0.1:1234", "ci").Code)
+	assert.Equal(t, http.StatusTooManyRequests, serve("10.0.0.3:1234", "ci").Code)
+}
+
+// Test that requests with missing or wrong keys are limited per IP in front
+// of the key check, while valid keys keep their own limit behind it
+func TestRateLimiter_InFrontOfAPIKeys(t *testing.T) {
+	store, err := auth.NewStaticKeyStore([]auth.Key{{ID: "ci", Hash: auth.HashKey("s3cret")}})
+	require.NoError(t, err)
+	ipLimit, _ := newTestLimiter(RateLimit{PerMinute: 60, Burst: 3})
+	keyLimit, _ := newTestLimiter(RateLimit{PerMinute: 60, Burst: 1})
+	handler := ipLimit.Middleware(APIKeyMiddleware(store)(keyLimit.Middleware(http.HandlerFunc(testHandler))))
+	serve := func(remoteAddr, key string) int {
+		req := httptest.NewRequest(http.MethodPost, "/shortURL", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-API-Key", key)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, serve("10.0.0.1:1234", "guess1"))
+	assert.Equal(t, http.StatusUnauthorized, serve("10.0.0.1:1234", "guess2"))
+	assert.Equal(t, http.StatusUnauthorized, serve("10.0.0.1:1234", ""))
+	assert.Equal(t, http.StatusTooManyRequests, serve("10.0.0.1:1234", "guess3"), "guessing is limited per IP")
+	assert.Equal(t, http.StatusTooManyRequests, serve("10.0.0.1:1234", "s3cret"))
+
+	assert.Equal(t, http.StatusOK, serve("10.0.0.2:1234", "s3cret"))
+	assert.Equal(t, http.StatusTooManyRequests, serve("10.0.0.3:1234", "s3cret"), "the key has its own limit")
+}
+
+func TestRateLimiter_AllowN(t *testing.T) {
+	l, clock := newTestLimiter(RateLimit{PerMinute: 60, Burst: 5})
+	ok, _ := l.AllowN("a", 3)
+	assert.True(t, ok)
+	ok, wait := l.AllowN("a", 3)
+	assert.False(t, ok, "only 2 tokens are left")
+	assert.Equal(t, time.Second, wait)
+	ok, _ = l.AllowN("a", 2)
+	assert.True(t, ok, "a refused request takes no tokens")
+
+	clock.now = clock.now.Add(time.Hour)
+	ok, wait = l.AllowN("a", 6)
+	assert.False(t, ok, "more than the burst never fits")
+	assert.Zero(t, wait)
+}
@@ -0,0 +1,37 @@
+package service
+
+import (
+	"regexp"
+	"strings"
+)
+
+const MinAliasLength = 3
+const MaxAliasLength = 64
+
+var aliasRe = regexp.MustCompile("^[a-zA-Z0-9_-]+$")
+
+// reservedAliases are paths served by the API itself; an alias must never shadow them.
+var reservedAliases = map[string]bool{
+	"shorturl":   true,
+	"metrics":    true,
+	"prometheus": true,
+	"stats":      true,
+	"api":        true,
+	"health":     true,
+	"healthz":    true,
+}
+
+// ValidateAlias checks a caller supplied short code against the allowed
+// character set, length bounds and the reserved route names.
+func ValidateAlias(alias string) error {
+	if len(alias) < MinAliasLength || len(alias) > MaxAliasLength {
+		return ErrInvalidAlias
+	}
+	if !aliasRe.MatchString(alias) {
+		return ErrInvalidAlias
+	}
+	if reservedAliases[strings.ToLower(alias)] {
+		return ErrReservedAlias
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package service
+
+import (
+	"cmp"
+	"context"
+	"log"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+	"urlshortener/internal/entities"
+)
+
+const clickBufferSize = 4096
+const clickBatchSize = 256
+const TopReferrersLimit = 10
+
+// RecordClick queues a followed redirect for analytics. It never blocks the
+// redirect: when the queue is full the click is dropped and logged.
+func (u *URLShortenService) RecordClick(code, referrer, userAgent string) {
+	device, browser := classifyUserAgent(userAgent)
+	click := entities.Click{
+		Code:     code,
+		Time:     time.Now(),
+		Referrer: referrerHost(referrer),
+		Device:   device,
+		Browser:  browser,
+	}
+	select {
+	case u.clicks <- click:
+	default:
+		log.Printf("Click queue full, dropping click for %s", code)
+	}
+}
+
+// RecordClicks drains the click queue into the store, batching whatever has
+// accumulated since the previous write. Once ctx is cancelled it writes the
+// clicks still queued and returns.
+func (u *URLShortenService) RecordClicks(ctx context.Context) {
+	batch := make([]entities.Click, 0, clickBatchSize)
+	for {
+		select {
+		case <-ctx.Done():
+			u.flushClicks(batch[:0])
+			return
+		case click := <-u.clicks:
+			u.flushClicks(append(batch[:0], click))
+		}
+	}
+}
+
+// flushClicks writes batch plus every click currently queued, up to
+// clickBatchSize per write.
+func (u *URLShortenService) flushClicks(batch []entities.Click) {
+	for {
+	drain:
+		for len(batch) < clickBatchSize {
+			select {
+			case click := <-u.clicks:
+				batch = append(batch, click)
+			default:
+				break drain
+			}
+		}
+		if len(batch) == 0 {
+			return
+		}
+		// the store must see the batch even while the server is shutting down
+		if err := u.db.RecordClicks(context.Background(), batch); err != nil {
+			log.Printf("Could not record %d clicks: %s", len(batch), err)
+		}
+		if len(batch) < clickBatchSize {
+			return
+		}
+		batch = batch[:0]
+	}
+}
+
+// LinkStats summarises the clicks of a short link, if owner may manage it.
+func (u *URLShortenService) LinkStats(ctx context.Context, code, owner string) (*entities.LinkStatsResponse, error) {
+	data, err := u.ownedLink(ctx, code, owner)
+	if err != nil {
+		return nil, err
+	}
+	resp := &entities.LinkStatsResponse{
+		ShortURL:     u.toResponse(data, "").ShortURl,
+		ClicksPerDay: []entities.DailyClicks{},
+		TopReferrers: []entities.NamedCount{},
+		Devices:      []entities.NamedCount{},
+		Browsers:     []entities.NamedCount{},
+	}
+	stats := u.db.RetrieveClickStats(ctx, code)
+	if stats == nil {
+		return resp, nil
+	}
+	resp.TotalClicks = stats.Total
+	for date, clicks := range stats.Daily {
+		resp.ClicksPerDay = append(resp.ClicksPerDay, entities.DailyClicks{Date: date, Clicks: clicks})
+	}
+	slices.SortFunc(resp.ClicksPerDay, func(a, b entities.DailyClicks) int {
+		return strings.Compare(a.Date, b.Date)
+	})
+	referrers := rankCounts(stats.Referrers)
+	for i := range referrers {
+		if referrers[i].Name == "" {
+			referrers[i].Name = "(direct)"
+		}
+	}
+	if len(referrers) > TopReferrersLimit {
+		referrers = referrers[:TopReferrersLimit]
+	}
+	resp.TopReferrers = referrers
+	resp.Devices = rankCounts(stats.Devices)
+	resp.Browsers = rankCounts(stats.Browsers)
+	return resp, nil
+}
+
+// rankCounts orders counts descending, breaking ties by name.
+func rankCounts(counts map[string]int) []entities.NamedCount {
+	ranked := make([]entities.NamedCount, 0, len(counts))
+	for name, count := range counts {
+		ranked = append(ranked, entities.NamedCount{Name: name, Count: count})
+	}
+	slices.SortFunc(ranked, func(a, b entities.NamedCount) int {
+		if c := cmp.Compare(b.Count, a.Count); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+	return ranked
+}
+
+// referrerHost keeps only the host of a Referer header, so analytics never
+// store paths or query strings of the referring page.
+func referrerHost(referrer string) string {
+	if referrer == "" {
+		return ""
+	}
+	u, err := url.Parse(referrer)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+var botMarkers = []string{"bot", "crawler", "spider", "slurp", "curl", "wget", "python-requests", "go-http-client", "facebookexternalhit"}
+
+// classifyUserAgent reduces a User-Agent to a coarse device class and browser family.
+func classifyUserAgent(userAgent string) (device, browser string) {
+	if userAgent == "" {
+		return "unknown", "unknown"
+	}
+	ua := strings.ToLower(userAgent)
+	switch {
+	case containsAny(ua, botMarkers...):
+		device = "bot"
+	case containsAny(ua, "mobi", "android", "iphone", "ipad"):
+		device = "mobile"
+	default:
+		device = "desktop"
+	}
+	switch {
+	case strings.Contains(ua, "edg/"):
+		browser = "Edge"
+	case containsAny(ua, "opr/", "opera"):
+		browser = "Opera"
+	case containsAny(ua, "chrome/", "crios/"):
+		browser = "Chrome"
+	case containsAny(ua, "firefox/", "fxios/"):
+		browser = "Firefox"
+	case strings.Contains(ua, "safari/"):
+		browser = "Safari"
+	default:
+		browser = "other"
+	}
+	return device, browser
+}
+
+func containsAny(s string, substrs ...string) bool {
+	for _, sub := range substrs {
+		if strings.Contains(s, sub) {
+			return true
+		}
+	}
+	return false
+}
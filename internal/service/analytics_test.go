@@ -0,0 +1,108 @@
+package service
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+	"urlshortener/internal/database"
+	"urlshortener/internal/entities"
+)
+
+func TestClassifyUserAgent(t *testing.T) {
+	tests := []struct {
+		ua      string
+		device  string
+		browser string
+	}{
+		{"", "unknown", "unknown"},
+		{"Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0", "desktop", "Firefox"},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Safari/537.36", "desktop", "Chrome"},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Safari/537.36 Edg/126.0.0.0", "desktop", "Edge"},
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 17_5 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.5 Mobile/15E148 Safari/604.1", "mobile", "Safari"},
+		{"Mozilla/5.0 (Linux; Android 14) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Mobile Safari/537.36", "mobile", "Chrome"},
+		{"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", "bot", "other"},
+		{"curl/8.5.0", "bot", "other"},
+	}
+	for _, tt := range tests {
+		device, browser := classifyUserAgent(tt.ua)
+		assert.Equal(t, tt.device, device, tt.ua)
+		assert.Equal(t, tt.browser, browser, tt.ua)
+	}
+}
+
+func TestReferrerHost(t *testing.T) {
+	assert.Equal(t, "", referrerHost(""))
+	assert.Equal(t, "news.ycombinator.com", referrerHost("https://News.YCombinator.com/item?id=1"))
+	assert.Equal(t, "example.com", referrerHost("http://example.com:8080/a/b"))
+	assert.Equal(t, "", referrerHost("not a url"))
+}
+
+// Test that queued clicks are aggregated into the link stats
+func TestURLShortenService_LinkStats(t *testing.T) {
+	db := database.NewInMemoryDatabase()
+	app := NewURLShortenService(db, "http://localhost:8080")
+	go app.RecordClicks(context.Background())
+	ctx := context.Background()
+	_, err := app.ShortenURL(ctx, entities.ShortenURLRequest{LongURL: "https://www.reddit.com/r/Fedora/", Alias: "fedora", Owner: "ci"})
+	assert.NoError(t, err)
+
+	stats, err := app.LinkStats(ctx, "fedora", "ci")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, stats.TotalClicks)
+	assert.Empty(t, stats.ClicksPerDay)
+
+	for i := 0; i < 3; i++ {
+		app.RecordClick("fedora", "https://news.ycombinator.com/item?id=1", "Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0")
+	}
+	app.RecordClick("fedora", "", "curl/8.5.0")
+	assert.Eventually(t, func() bool {
+		stats, err = app.LinkStats(ctx, "fedora", "ci")
+		return err == nil && stats.TotalClicks == 4
+	}, 2*time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, "http://localhost:8080/fedora", stats.ShortURL)
+	assert.Equal(t, []entities.DailyClicks{{Date: time.Now().UTC().Format("2006-01-02"), Clicks: 4}}, stats.ClicksPerDay)
+	assert.Equal(t, []entities.NamedCount{{Name: "news.ycombinator.com", Count: 3}, {Name: "(direct)", Count: 1}}, stats.TopReferrers)
+	assert.Equal(t, []entities.NamedCount{{Name: "desktop", Count: 3}, {Name: "bot", Count: 1}}, stats.Devices)
+	assert.Equal(t, []entities.NamedCount{{Name: "Firefox", Count: 3}, {Name: "other", Count: 1}}, stats.Browsers)
+}
+
+// Test stats of an unknown link
+func TestURLShortenService_LinkStats_NotFound(t *testing.T) {
+	app := NewURLShortenService(database.NewInMemoryDatabase(), "http://localhost:8080")
+	_, err := app.LinkStats(context.Background(), "NOPE42", "ci")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+// Test that only the owner of a link sees its stats
+func TestURLShortenService_LinkStats_Owner(t *testing.T) {
+	app, _ := newLinkTestService(t)
+	ctx := context.Background()
+	stats, err := app.LinkStats(ctx, "fedora", "ci")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://sho.rt/fedora", stats.ShortURL)
+	_, err = app.LinkStats(ctx, "fedora", "ops")
+	assert.ErrorIs(t, err, ErrForbidden)
+	_, err = app.LinkStats(ctx, "fedora", "")
+	assert.ErrorIs(t, err, ErrUnauthenticated)
+}
+
+// Test that clicks still queued when the worker is cancelled are written
+func TestURLShortenService_RecordClicks_FlushOnCancel(t *testing.T) {
+	db := database.NewInMemoryDatabase()
+	app := NewURLShortenService(db, "http://localhost:8080")
+	ctx := context.Background()
+	_, err := app.ShortenURL(ctx, entities.ShortenURLRequest{LongURL: "https://www.reddit.com/r/Fedora/", Alias: "fedora"})
+	assert.NoError(t, err)
+
+	// queue more than one batch before the worker ever runs
+	for i := 0; i < clickBatchSize+10; i++ {
+		app.RecordClick("fedora", "", "curl/8.5.0")
+	}
+	workerCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	app.RecordClicks(workerCtx)
+
+	assert.Equal(t, clickBatchSize+10, db.RetrieveClickStats(ctx, "fedora").Total)
+}
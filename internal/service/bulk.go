@@ -0,0 +1,52 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"urlshortener/internal/entities"
+)
+
+const DefaultBulkConcurrency = 8
+
+// MaxBulkItems caps the number of links in one bulk request, or in one batch
+// of a streamed bulk request.
+const MaxBulkItems = 10000
+
+// BulkBatchSize is how many lines of a streamed bulk request are shortened
+// together before their results are written and flushed.
+const BulkBatchSize = 256
+
+// BulkResult is the outcome of one request of ShortenURLs: either Response or Err is set.
+type BulkResult struct {
+	Response *entities.ShortenURLResponse
+	Err      error
+}
+
+// ShortenURLs shortens every request with at most bulkConcurrency in flight
+// and returns the results in request order. A failing item does not stop the
+// others.
+func (u *URLShortenService) ShortenURLs(ctx context.Context, requests []entities.ShortenURLRequest) ([]BulkResult, error) {
+	if len(requests) > MaxBulkItems {
+		return nil, ErrTooManyItems
+	}
+	results := make([]BulkResult, len(requests))
+	workers := min(max(u.bulkConcurrency, 1), len(requests))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				resp, err := u.ShortenURL(ctx, requests[i])
+				results[i] = BulkResult{Response: resp, Err: err}
+			}
+		}()
+	}
+	for i := range requests {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return results, nil
+}
@@ -0,0 +1,111 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"urlshortener/internal/database"
+	"urlshortener/internal/entities"
+)
+
+// slowDB counts how many link creations run at once.
+type slowDB struct {
+	database.DB
+	inFlight, peak atomic.Int32
+}
+
+func (s *slowDB) GetOrCreate(ctx context.Context, key string, data entities.ShortURLDBData) (*entities.ShortURLDBData, bool, error) {
+	n := s.inFlight.Add(1)
+	defer s.inFlight.Add(-1)
+	for {
+		peak := s.peak.Load()
+		if n <= peak || s.peak.CompareAndSwap(peak, n) {
+			break
+		}
+	}
+	time.Sleep(time.Millisecond)
+	return s.DB.GetOrCreate(ctx, key, data)
+}
+
+// Test that results keep the request order and failures stay per item
+func TestURLShortenService_ShortenURLs(t *testing.T) {
+	db := &slowDB{DB: database.NewInMemoryDatabase()}
+	app := NewURLShortenService(db, "http://localhost:8080", WithBulkConcurrency(4))
+	var requests []entities.ShortenURLRequest
+	for i := 0; i < 50; i++ {
+		requests = append(requests, entities.ShortenURLRequest{LongURL: fmt.Sprintf("https://www.reddit.com/r/%d", i)})
+	}
+	requests[10].LongURL = "not a url"
+	requests[20].Alias = "x"
+	results, err := app.ShortenURLs(context.Background(), requests)
+	require.NoError(t, err)
+	require.Len(t, results, 50)
+	for i, result := range results {
+		switch i {
+		case 10:
+			assert.ErrorIs(t, result.Err, ErrInvalidURL)
+		case 20:
+			assert.ErrorIs(t, result.Err, ErrInvalidAlias)
+		default:
+			require.NoError(t, result.Err, i)
+			resp, err := app.RedirectURL(context.Background(), result.Response.ShortURl[len("http://localhost:8080/"):])
+			require.NoError(t, err)
+			assert.Equal(t, requests[i].LongURL, resp.LongURl)
+		}
+	}
+	assert.LessOrEqual(t, db.peak.Load(), int32(4))
+	assert.Greater(t, db.peak.Load(), int32(1), "items should be processed concurrently")
+}
+
+// Test that the same URL repeated in one bulk request yields a single link
+func TestURLShortenService_ShortenURLs_Duplicates(t *testing.T) {
+	db := database.NewInMemoryDatabase()
+	app := NewURLShortenService(db, "http://localhost:8080", WithBulkConcurrency(16))
+	requests := make([]entities.ShortenURLRequest, 32)
+	for i := range requests {
+		requests[i] = entities.ShortenURLRequest{LongURL: "https://www.reddit.com/r/Fedora/"}
+	}
+	results, err := app.ShortenURLs(context.Background(), requests)
+	require.NoError(t, err)
+	created := 0
+	for _, result := range results {
+		require.NoError(t, result.Err)
+		assert.Equal(t, results[0].Response.ShortURl, result.Response.ShortURl)
+		if result.Response.Status == entities.LinkCreated {
+			created++
+		}
+	}
+	assert.Equal(t, 1, created)
+	assert.Equal(t, 1, db.CountLinks(context.Background()))
+}
+
+func TestURLShortenService_ShortenURLs_Limits(t *testing.T) {
+	app := NewURLShortenService(database.NewInMemoryDatabase(), "http://localhost:8080")
+	results, err := app.ShortenURLs(context.Background(), nil)
+	assert.NoError(t, err)
+	assert.Empty(t, results)
+	_, err = app.ShortenURLs(context.Background(), make([]entities.ShortenURLRequest, MaxBulkItems+1))
+	assert.ErrorIs(t, err, ErrTooManyItems)
+}
+
+// Test that concurrent single requests for one URL also converge on one link
+func TestURLShortenService_ShortenURL_ConcurrentDuplicates(t *testing.T) {
+	db := database.NewInMemoryDatabase()
+	app := NewURLShortenService(db, "http://localhost:8080")
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := app.ShortenURL(context.Background(), entities.ShortenURLRequest{LongURL: "https://www.reddit.com/r/Fedora/"})
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1, db.CountLinks(context.Background()))
+}
@@ -0,0 +1,143 @@
+package service
+
+import (
+	"fmt"
+	"golang.org/x/net/idna"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Canonicalization holds the optional steps of long URL canonicalization.
+// Lower-casing the scheme and host, converting IDN hosts to punycode, dropping
+// the default port and resolving "." and ".." path segments always apply.
+type Canonicalization struct {
+	SortQuery bool // order query parameters by name, keeping the order of repeated ones
+	// query parameters removed from every URL: exact names, or prefixes
+	// ending in "*" such as utm_*
+	StripParams []string
+}
+
+// ValidateParamPattern checks a StripParams entry.
+func ValidateParamPattern(pattern string) error {
+	name := strings.TrimSuffix(pattern, "*")
+	if name == "" || strings.ContainsAny(name, "*&=# ") {
+		return fmt.Errorf("invalid query parameter pattern %q, use a name or a prefix such as utm_*", pattern)
+	}
+	return nil
+}
+
+// Canonicalize rewrites URL in place to its canonical form, so that spellings
+// of the same address share one dedup key, stored URL and domain counter.
+func (c Canonicalization) Canonicalize(URL *url.URL) error {
+	URL.Scheme = strings.ToLower(URL.Scheme)
+	host, err := canonicalHost(URL.Hostname())
+	if err != nil {
+		return err
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if port := URL.Port(); port != "" && !(URL.Scheme == "http" && port == "80") && !(URL.Scheme == "https" && port == "443") {
+		host += ":" + port
+	}
+	URL.Host = host
+
+	path := removeDotSegments(URL.EscapedPath())
+	if URL.Path, err = url.PathUnescape(path); err != nil {
+		return err
+	}
+	URL.RawPath = path
+
+	URL.ForceQuery = false
+	if URL.RawQuery != "" && (c.SortQuery || len(c.StripParams) > 0) {
+		URL.RawQuery = c.canonicalQuery(URL.RawQuery)
+	}
+	return nil
+}
+
+// canonicalQuery drops empty and stripped parameters from a raw query and
+// sorts the rest when asked to. Values keep their original encoding.
+func (c Canonicalization) canonicalQuery(raw string) string {
+	type param struct{ name, raw string }
+	var params []param
+	for _, pair := range strings.Split(raw, "&") {
+		if pair == "" {
+			continue
+		}
+		name, _, _ := strings.Cut(pair, "=")
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		if c.stripped(name) {
+			continue
+		}
+		params = append(params, param{name, pair})
+	}
+	if c.SortQuery {
+		sort.SliceStable(params, func(i, j int) bool { return params[i].name < params[j].name })
+	}
+	pairs := make([]string, len(params))
+	for i, p := range params {
+		pairs[i] = p.raw
+	}
+	return strings.Join(pairs, "&")
+}
+
+func (c Canonicalization) stripped(name string) bool {
+	for _, pattern := range c.StripParams {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if name == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// hostIDNA is the IDNA lookup profile, except that it keeps underscores and
+// other ASCII the STD3 host name rules forbid, which real hosts do use.
+var hostIDNA = idna.New(idna.MapForLookup(), idna.BidiRule(), idna.StrictDomainName(false))
+
+// canonicalHost maps host with IDNA (UTS #46): it is lower-cased and
+// normalised, and its internationalised labels are encoded as punycode
+// (xn--...). Hosts IDNA rejects are invalid. IPv6 addresses are written in
+// their shortest form and a trailing root dot is dropped.
+func canonicalHost(host string) (string, error) {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if ip := net.ParseIP(host); ip != nil && strings.Contains(host, ":") {
+		return ip.String(), nil
+	}
+	return hostIDNA.ToASCII(host)
+}
+
+// removeDotSegments resolves "." and ".." segments of an escaped path as in
+// RFC 3986 section 5.2.4. An empty path becomes "/".
+func removeDotSegments(path string) string {
+	if path == "" {
+		return "/"
+	}
+	segments := strings.Split(path, "/")[1:]
+	out := make([]string, 0, len(segments))
+	for i, segment := range segments {
+		last := i == len(segments)-1
+		switch segment {
+		case ".":
+		case "..":
+			if len(out) > 0 {
+				out = out[:len(out)-1]
+			}
+		default:
+			out = append(out, segment)
+			continue
+		}
+		// a trailing dot segment names a directory
+		if last {
+			out = append(out, "")
+		}
+	}
+	return "/" + strings.Join(out, "/")
+}
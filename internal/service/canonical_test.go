@@ -0,0 +1,112 @@
+package service
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/url"
+	"testing"
+	"time"
+	"urlshortener/internal/database"
+	"urlshortener/internal/entities"
+)
+
+func TestCanonicalization_Canonicalize(t *testing.T) {
+	tracking := Canonicalization{SortQuery: true, StripParams: []string{"utm_*", "fbclid"}}
+	tests := []struct {
+		name  string
+		c     Canonicalization
+		input string
+		want  string
+	}{
+		{name: "case", input: "HTTPS://Example.COM/Path", want: "https://example.com/Path"},
+		{name: "empty path", input: "https://example.com", want: "https://example.com/"},
+		{name: "https default port", input: "https://example.com:443/", want: "https://example.com/"},
+		{name: "http default port", input: "http://example.com:80/a", want: "http://example.com/a"},
+		{name: "other port", input: "http://example.com:443/a", want: "http://example.com:443/a"},
+		{name: "dot segments", input: "https://example.com/a/./b/../c", want: "https://example.com/a/c"},
+		{name: "trailing dot segment", input: "https://example.com/a/b/..", want: "https://example.com/a/"},
+		{name: "above root", input: "https://example.com/../../a", want: "https://example.com/a"},
+		{name: "encoded path kept", input: "https://zh.wikipedia.org/wiki/%E7%99%BE%E5%BA%A6", want: "https://zh.wikipedia.org/wiki/%E7%99%BE%E5%BA%A6"},
+		{name: "encoded slash kept", input: "https://example.com/a%2Fb/../c", want: "https://example.com/c"},
+		{name: "idn", input: "https://Bücher.example/", want: "https://xn--bcher-kva.example/"},
+		{name: "idn with port", input: "https://münchen.de:8443/", want: "https://xn--mnchen-3ya.de:8443/"},
+		{name: "ipv6", input: "http://[2001:DB8::1]:80/", want: "http://[2001:db8::1]/"},
+		{name: "query order kept by default", input: "https://example.com/?b=2&a=1&utm_source=x", want: "https://example.com/?b=2&a=1&utm_source=x"},
+		{name: "empty query dropped", input: "https://example.com/?", want: "https://example.com/"},
+		{name: "query sorted", c: tracking, input: "https://example.com/?b=2&a=1&b=1", want: "https://example.com/?a=1&b=2&b=1"},
+		{name: "tracking stripped", c: tracking, input: "https://example.com/p?utm_source=x&id=7&fbclid=abc&utm_medium=y#top", want: "https://example.com/p?id=7#top"},
+		{name: "all params stripped", c: tracking, input: "https://example.com/?utm_source=x", want: "https://example.com/"},
+		{name: "encoded param name", c: Canonicalization{StripParams: []string{"utm_*"}}, input: "https://example.com/?utm%5Fsource=x&q=a%20b", want: "https://example.com/?q=a%20b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			URL, err := url.Parse(tt.input)
+			require.NoError(t, err)
+			require.NoError(t, tt.c.Canonicalize(URL))
+			assert.Equal(t, tt.want, URL.String())
+		})
+	}
+}
+
+// Test that hosts are mapped and validated with IDNA, not only case folded
+func TestCanonicalHost(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{input: "Bücher.Example", want: "xn--bcher-kva.example"},
+		{input: "ｅｘａｍｐｌｅ.com", want: "example.com"},
+		{input: "faß.de", want: "xn--fa-hia.de"},
+		{input: "ﬁle.example", want: "file.example"},
+		{input: "example.com.", want: "example.com"},
+		{input: "2001:DB8:0:0::1", want: "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		got, err := canonicalHost(tt.input)
+		require.NoError(t, err, tt.input)
+		assert.Equal(t, tt.want, got, tt.input)
+	}
+
+	for _, host := range []string{"-bad.example", "xn--a.example", "aא.example"} {
+		_, err := canonicalHost(host)
+		assert.Error(t, err, host)
+	}
+}
+
+// Test that spellings of the same URL share one link, stored canonically
+func TestURLShortenService_Canonicalization(t *testing.T) {
+	db := database.NewInMemoryDatabase()
+	app := NewURLShortenService(db, "https://sho.rt", WithCanonicalization(Canonicalization{SortQuery: true, StripParams: []string{"utm_*"}}))
+	ctx := context.Background()
+
+	first, err := app.ShortenURL(ctx, entities.ShortenURLRequest{LongURL: "https://example.com/?a=1&b=2"})
+	require.NoError(t, err)
+	for _, spelling := range []string{
+		"https://Example.com:443/?b=2&a=1",
+		"HTTPS://EXAMPLE.COM/./?a=1&utm_source=news&b=2",
+	} {
+		resp, err := app.ShortenURL(ctx, entities.ShortenURLRequest{LongURL: spelling})
+		require.NoError(t, err)
+		assert.Equal(t, entities.LinkExisting, resp.Status, spelling)
+		assert.Equal(t, first.ShortURl, resp.ShortURl, spelling)
+	}
+	other, err := app.ShortenURL(ctx, entities.ShortenURLRequest{LongURL: "https://example.com/?a=1&b=3"})
+	require.NoError(t, err)
+	assert.NotEqual(t, first.ShortURl, other.ShortURl)
+
+	_, err = app.ShortenURL(ctx, entities.ShortenURLRequest{LongURL: "https://EXAMPLE.com/?b=2&a=1", Alias: "example"})
+	require.NoError(t, err)
+	again, err := app.ShortenURL(ctx, entities.ShortenURLRequest{LongURL: "https://example.com?a=1&b=2", Alias: "example"})
+	require.NoError(t, err, "the alias is idempotent for any spelling of its URL")
+	assert.Equal(t, entities.LinkExisting, again.Status)
+
+	redirect, err := app.RedirectURL(ctx, "example")
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/?a=1&b=2", redirect.LongURl)
+	db.PopulateTopDomains(ctx, time.Now())
+	top := db.RetrieveTopDomains(ctx, 10, 0)
+	require.Len(t, top, 1)
+	assert.Equal(t, "example.com", top[0].Domain)
+	assert.Equal(t, 3, top[0].Count)
+}
@@ -0,0 +1,152 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"math/big"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// CodeGenerator mints candidate short codes. The service checks every
+// candidate against the store and asks again with the next attempt number on
+// a collision, raising length after a few attempts.
+type CodeGenerator interface {
+	Generate(ctx context.Context, longURL string, attempt, length int) (string, error)
+}
+
+// Alphabets of the generated codes.
+const (
+	base62Alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	// readableAlphabet leaves out characters that are easily confused when
+	// read aloud or retyped: 0/O/o, 1/l/I/i, and upper case altogether.
+	readableAlphabet = "23456789abcdefghjkmnpqrstuvwxyz"
+)
+
+// Names of the code generators, as accepted by NewCodeGenerator.
+const (
+	HashCodes     = "hash"
+	SequenceCodes = "sequence"
+	RandomCodes   = "random"
+	ReadableCodes = "readable"
+)
+
+// CodeGenerators lists the generator names, the default first.
+var CodeGenerators = []string{HashCodes, SequenceCodes, RandomCodes, ReadableCodes}
+
+// NewCodeGenerator returns the generator called name. sequences keeps the
+// position of the sequence generator and is ignored by the others.
+func NewCodeGenerator(name string, sequences SequenceStore) (CodeGenerator, error) {
+	switch name {
+	case HashCodes:
+		return HashGenerator{}, nil
+	case SequenceCodes:
+		return NewSequenceGenerator(sequences), nil
+	case RandomCodes:
+		return RandomGenerator{Alphabet: base62Alphabet}, nil
+	case ReadableCodes:
+		return RandomGenerator{Alphabet: readableAlphabet}, nil
+	}
+	return nil, fmt.Errorf("unknown code generator %q, use one of %s", name, strings.Join(CodeGenerators, ", "))
+}
+
+// HashGenerator derives codes from the SHA-256 sum of the long URL, so the
+// same URL always gets the same first candidate. The sum is written in
+// case-preserving base62; later attempts hash the URL with the attempt number.
+type HashGenerator struct{}
+
+func (HashGenerator) Generate(ctx context.Context, longURL string, attempt, length int) (string, error) {
+	input := longURL
+	if attempt > 0 {
+		input += "#" + strconv.Itoa(attempt)
+	}
+	sum := sha256.Sum256([]byte(input))
+	return encodeBase62(new(big.Int).SetBytes(sum[:]), length), nil
+}
+
+// encodeBase62 writes the length least significant base62 digits of n.
+func encodeBase62(n *big.Int, length int) string {
+	code := make([]byte, length)
+	base := big.NewInt(int64(len(base62Alphabet)))
+	digit := new(big.Int)
+	for i := range code {
+		n.DivMod(n, base, digit)
+		code[i] = base62Alphabet[digit.Int64()]
+	}
+	return string(code)
+}
+
+// SequenceStore persists how far the code sequence got, so that numbers are
+// never handed out twice; database.DB is one.
+type SequenceStore interface {
+	// ReserveSequence reserves the next n numbers and returns the first.
+	ReserveSequence(ctx context.Context, n uint64) (uint64, error)
+}
+
+// sequenceBlock is how many numbers a SequenceGenerator reserves at once.
+// The unused rest of a block is skipped after a restart.
+const sequenceBlock = 100
+
+// SequenceGenerator hands out consecutive numbers in base62, left padded with
+// zeros to the code length. Codes are short and never collide with each
+// other, but they are predictable: anyone can enumerate the links.
+type SequenceGenerator struct {
+	store     SequenceStore
+	mu        sync.Mutex
+	next, end uint64 // the reserved numbers not handed out yet
+}
+
+// NewSequenceGenerator returns a sequence that reserves its numbers in
+// blocks from store, so it resumes where it left off after a restart, even
+// if the links with the highest codes have been deleted since.
+func NewSequenceGenerator(store SequenceStore) *SequenceGenerator {
+	return &SequenceGenerator{store: store}
+}
+
+func (g *SequenceGenerator) Generate(ctx context.Context, longURL string, attempt, length int) (string, error) {
+	g.mu.Lock()
+	if g.next == g.end {
+		start, err := g.store.ReserveSequence(ctx, sequenceBlock)
+		if err != nil {
+			g.mu.Unlock()
+			return "", err
+		}
+		g.next, g.end = start, start+sequenceBlock
+	}
+	n := g.next
+	g.next++
+	g.mu.Unlock()
+	var digits []byte
+	for ; n > 0; n /= 62 {
+		digits = append(digits, base62Alphabet[n%62])
+	}
+	for len(digits) < length {
+		digits = append(digits, '0')
+	}
+	// most significant digit first; codes outgrowing length get longer
+	slices.Reverse(digits)
+	return string(digits), nil
+}
+
+// RandomGenerator draws every character uniformly from Alphabet using
+// crypto/rand, so codes cannot be guessed from each other.
+type RandomGenerator struct {
+	Alphabet string
+}
+
+func (g RandomGenerator) Generate(ctx context.Context, longURL string, attempt, length int) (string, error) {
+	code := make([]byte, length)
+	size := big.NewInt(int64(len(g.Alphabet)))
+	for i := range code {
+		n, err := rand.Int(rand.Reader, size)
+		if err != nil {
+			return "", err
+		}
+		code[i] = g.Alphabet[n.Int64()]
+	}
+	return string(code), nil
+}
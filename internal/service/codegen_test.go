@@ -0,0 +1,212 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"urlshortener/internal/database"
+	"urlshortener/internal/entities"
+)
+
+// collisions generates n codes of length for distinct URLs and counts the
+// codes that were already generated.
+func collisions(t *testing.T, g CodeGenerator, n, length int) int {
+	t.Helper()
+	seen := make(map[string]bool, n)
+	count := 0
+	for i := 0; i < n; i++ {
+		code, err := g.Generate(context.Background(), fmt.Sprintf("https://example.com/%d", i), 0, length)
+		require.NoError(t, err)
+		require.Len(t, code, length)
+		if seen[code] {
+			count++
+		}
+		seen[code] = true
+	}
+	return count
+}
+
+// expectedCollisions is the birthday estimate of repeated codes among n codes
+// drawn uniformly from alphabet^length.
+func expectedCollisions(n, alphabet, length int) float64 {
+	space := math.Pow(float64(alphabet), float64(length))
+	return float64(n) - space*(1-math.Pow(1-1/space, float64(n)))
+}
+
+// Test that hash and random codes collide no more often than uniform codes
+// over their alphabet would: 20000 four character codes are expected to
+// repeat about 13.5 times over base62, but about 118 times over the 36
+// characters left by upper-casing.
+func TestCodeGenerators_CollisionProbability(t *testing.T) {
+	const n, length = 20000, 4
+	tests := []struct {
+		name     string
+		g        CodeGenerator
+		alphabet int
+	}{
+		{name: "hash", g: HashGenerator{}, alphabet: 62},
+		{name: "random", g: RandomGenerator{Alphabet: base62Alphabet}, alphabet: 62},
+		{name: "readable", g: RandomGenerator{Alphabet: readableAlphabet}, alphabet: len(readableAlphabet)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expected := expectedCollisions(n, tt.alphabet, length)
+			got := collisions(t, tt.g, n, length)
+			// far above the 1e-6 tail of the Poisson distribution for 13.5 to 26
+			assert.LessOrEqual(t, float64(got), 3*expected+15, "expected about %.1f collisions", expected)
+			if tt.alphabet == 62 {
+				assert.Less(t, float64(got), expectedCollisions(n, 36, length)/2, "codes use the whole base62 alphabet")
+			}
+		})
+	}
+	t.Run("readable space", func(t *testing.T) {
+		// readable codes need one more character for the same odds
+		assert.Less(t, expectedCollisions(n, len(readableAlphabet), length+1), expectedCollisions(n, 62, length))
+	})
+}
+
+// Test that every character of the alphabet shows up, and nothing else
+func TestCodeGenerators_Alphabet(t *testing.T) {
+	for _, tt := range []struct {
+		g        CodeGenerator
+		alphabet string
+	}{
+		{HashGenerator{}, base62Alphabet},
+		{RandomGenerator{Alphabet: base62Alphabet}, base62Alphabet},
+		{RandomGenerator{Alphabet: readableAlphabet}, readableAlphabet},
+	} {
+		used := map[rune]bool{}
+		for i := 0; i < 2000; i++ {
+			code, err := tt.g.Generate(context.Background(), fmt.Sprintf("https://example.com/%d", i), 0, 6)
+			require.NoError(t, err)
+			for _, c := range code {
+				require.Contains(t, tt.alphabet, string(c))
+				used[c] = true
+			}
+		}
+		assert.Len(t, used, len(tt.alphabet), "%T %s", tt.g, tt.alphabet)
+	}
+	assert.False(t, strings.ContainsAny(readableAlphabet, "0Oo1lIi"))
+}
+
+func TestHashGenerator(t *testing.T) {
+	ctx := context.Background()
+	g := HashGenerator{}
+	first, _ := g.Generate(ctx, "https://www.reddit.com/r/Fedora/", 0, 6)
+	again, _ := g.Generate(ctx, "https://www.reddit.com/r/Fedora/", 0, 6)
+	retry, _ := g.Generate(ctx, "https://www.reddit.com/r/Fedora/", 1, 6)
+	longer, _ := g.Generate(ctx, "https://www.reddit.com/r/Fedora/", 0, 8)
+	assert.Equal(t, first, again, "the first candidate only depends on the URL")
+	assert.NotEqual(t, first, retry)
+	assert.True(t, strings.HasPrefix(longer, first), "longer codes extend shorter ones")
+}
+
+func TestSequenceGenerator(t *testing.T) {
+	ctx := context.Background()
+	db := database.NewInMemoryDatabase()
+	_, _ = db.ReserveSequence(ctx, 61)
+	g := NewSequenceGenerator(db)
+	for _, want := range []string{"000z", "0010", "0011"} {
+		code, err := g.Generate(ctx, "", 0, 4)
+		require.NoError(t, err)
+		assert.Equal(t, want, code)
+	}
+	db = database.NewInMemoryDatabase()
+	_, _ = db.ReserveSequence(ctx, 62*62*62*62)
+	code, _ := NewSequenceGenerator(db).Generate(ctx, "", 0, 4)
+	assert.Equal(t, "10000", code, "the sequence outgrows the code length")
+
+	// never a collision, even when shared by concurrent requests
+	g = NewSequenceGenerator(database.NewInMemoryDatabase())
+	var mu sync.Mutex
+	seen := map[string]bool{}
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				code, _ := g.Generate(ctx, "", 0, 4)
+				mu.Lock()
+				assert.False(t, seen[code], code)
+				seen[code] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Len(t, seen, 8000)
+}
+
+// Test that a sequence resumes after the numbers it reserved, not after the
+// links that are left in the store
+func TestSequenceGenerator_Resumes(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "urls.db")
+	db, err := database.NewFileDatabase(path)
+	require.NoError(t, err)
+	app := NewURLShortenService(db, "http://localhost:8080", WithCodeGenerator(NewSequenceGenerator(db)))
+	var codes []string
+	for i := 0; i < 3; i++ {
+		resp, err := app.ShortenURL(ctx, entities.ShortenURLRequest{LongURL: fmt.Sprintf("https://example.com/%d", i)})
+		require.NoError(t, err)
+		codes = append(codes, strings.TrimPrefix(resp.ShortURl, "http://localhost:8080/"))
+	}
+	for _, code := range codes {
+		require.NoError(t, db.DeleteData(ctx, code))
+	}
+	require.NoError(t, db.Close())
+
+	db, err = database.NewFileDatabase(path)
+	require.NoError(t, err)
+	defer db.Close()
+	require.Zero(t, db.CountLinks(ctx))
+	code, err := NewSequenceGenerator(db).Generate(ctx, "", 0, 6)
+	require.NoError(t, err)
+	assert.NotContains(t, codes, code, "deleted codes are not handed out again")
+	assert.Equal(t, "00001c", code, "the sequence resumes after its first reserved block")
+}
+
+func TestNewCodeGenerator(t *testing.T) {
+	for _, name := range CodeGenerators {
+		g, err := NewCodeGenerator(name, database.NewInMemoryDatabase())
+		require.NoError(t, err, name)
+		assert.NotNil(t, g)
+	}
+	_, err := NewCodeGenerator("uuid", nil)
+	assert.ErrorContains(t, err, `unknown code generator "uuid"`)
+}
+
+// fixedCodes returns codes in order, then the last one forever.
+type fixedCodes []string
+
+func (f fixedCodes) Generate(ctx context.Context, longURL string, attempt, length int) (string, error) {
+	return f[min(attempt, len(f)-1)], nil
+}
+
+// Test that the service skips taken codes and reserved route names
+func TestURLShortenService_WithCodeGenerator(t *testing.T) {
+	db := database.NewInMemoryDatabase()
+	ctx := context.Background()
+	app := NewURLShortenService(db, "http://localhost:8080", WithCodeGenerator(fixedCodes{"Health", "taken", "free42"}))
+	require.NoError(t, db.AddData(ctx, "taken", entities.ShortURLDBData{LongURL: "https://other.com/", ShortURl: "taken"}))
+	resp, err := app.ShortenURL(ctx, entities.ShortenURLRequest{LongURL: "https://www.reddit.com/r/Fedora/"})
+	require.NoError(t, err)
+	assert.Equal(t, "http://localhost:8080/free42", resp.ShortURl)
+
+	_, err = app.ShortenURL(ctx, entities.ShortenURLRequest{LongURL: "https://www.wikipedia.org/"})
+	assert.ErrorIs(t, err, ErrHashExhausted, "a generator stuck on taken codes gives up")
+
+	app = NewURLShortenService(database.NewInMemoryDatabase(), "http://localhost:8080", WithCodeGenerator(NewSequenceGenerator(database.NewInMemoryDatabase())))
+	for _, want := range []string{"000000", "000001"} {
+		resp, err := app.ShortenURL(ctx, entities.ShortenURLRequest{LongURL: "https://www.wikipedia.org/" + want})
+		require.NoError(t, err)
+		assert.Equal(t, "http://localhost:8080/"+want, resp.ShortURl)
+	}
+}
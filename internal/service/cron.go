@@ -2,13 +2,48 @@ package service
 
 import (
 	"context"
+	"log"
 	"time"
 )
 
-func (u *URLShortenService) PopulateTopDomains() {
+const DefaultReapInterval = time.Minute
+const DefaultTopDomainsInterval = 2 * time.Second
+
+// PopulateTopDomains refreshes the top domains ranking every topDomainsInterval
+// until ctx is cancelled.
+func (u *URLShortenService) PopulateTopDomains(ctx context.Context) {
+	ticker := time.NewTicker(u.topDomainsInterval)
+	defer ticker.Stop()
+	for {
+		u.db.PopulateTopDomains(ctx, time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ReapExpiredLinks periodically purges expired links from the store until ctx
+// is cancelled.
+func (u *URLShortenService) ReapExpiredLinks(ctx context.Context) {
+	ticker := time.NewTicker(u.reapInterval)
+	defer ticker.Stop()
 	for {
-		ctx := context.Background()
-		u.db.PopulateTop3Domain(ctx)
-		time.Sleep(2 * time.Second)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			u.PurgeExpired(ctx)
+		}
+	}
+}
+
+// PurgeExpired removes every expired link and returns how many were removed.
+func (u *URLShortenService) PurgeExpired(ctx context.Context) int {
+	removed := u.db.PurgeExpired(ctx, time.Now())
+	if removed > 0 {
+		log.Printf("Purged %d expired links", removed)
 	}
+	return removed
 }
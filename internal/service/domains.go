@@ -0,0 +1,101 @@
+package service
+
+import (
+	"net/url"
+	"strings"
+	"urlshortener/internal/database"
+)
+
+// shortDomain is a short domain served by this instance.
+type shortDomain struct {
+	base      string // public base URL, e.g. https://b.co
+	host      string // lower-cased host[:port] of base
+	namespace string // code namespace, empty for the default domain
+}
+
+// newDomains builds the registry: the default domain first, then the others.
+// Every domain but the default keeps its codes in its own namespace.
+func newDomains(defaultBase string, others []string) []shortDomain {
+	domains := []shortDomain{{base: defaultBase, host: DomainHost(defaultBase)}}
+	for _, base := range others {
+		base = strings.TrimSuffix(base, "/")
+		host := DomainHost(base)
+		if host == domains[0].host {
+			continue
+		}
+		domains = append(domains, shortDomain{base: base, host: host, namespace: host})
+	}
+	return domains
+}
+
+// DomainHost returns the lower-cased host[:port] that identifies a short
+// domain, given as a base URL or a bare host. The port is dropped only when it
+// is the default of the URL's scheme, so https://b.co:443 is b.co while
+// https://b.co:80 keeps its port; a bare host has no scheme and keeps any port.
+// It returns "" for a base URL that does not parse.
+func DomainHost(domain string) string {
+	if !strings.Contains(domain, "://") {
+		return strings.ToLower(strings.TrimSuffix(domain, "/"))
+	}
+	u, err := url.Parse(domain)
+	if err != nil {
+		return ""
+	}
+	host := strings.ToLower(u.Host)
+	if port := u.Port(); (port == "80" && u.Scheme == "http") || (port == "443" && u.Scheme == "https") {
+		host = strings.TrimSuffix(host, ":"+port)
+	}
+	return host
+}
+
+// lookupDomain returns the registered domain named by a base URL or host.
+func (u *URLShortenService) lookupDomain(domain string) *shortDomain {
+	host := DomainHost(domain)
+	for i := range u.domains {
+		if u.domains[i].host == host {
+			return &u.domains[i]
+		}
+	}
+	return nil
+}
+
+// resolveDomain returns the domain a link is created on: the default one when
+// requested is empty, otherwise the registered domain it names.
+func (u *URLShortenService) resolveDomain(requested string) (*shortDomain, error) {
+	if requested == "" {
+		return &u.domains[0], nil
+	}
+	if d := u.lookupDomain(requested); d != nil {
+		return d, nil
+	}
+	return nil, ErrUnknownDomain
+}
+
+// LinkKey returns the store key of code on domain, a base URL or host; an
+// empty domain means the default one.
+func (u *URLShortenService) LinkKey(domain, code string) (string, error) {
+	d, err := u.resolveDomain(domain)
+	if err != nil {
+		return "", err
+	}
+	return database.NamespacedKey(d.namespace, code), nil
+}
+
+// HostKey returns the store key of code requested on host, the Host header of
+// a redirect. Hosts that are not registered resolve to the default domain.
+func (u *URLShortenService) HostKey(host, code string) string {
+	d := u.lookupDomain(host)
+	if d == nil {
+		d = &u.domains[0]
+	}
+	return database.NamespacedKey(d.namespace, code)
+}
+
+// ownHosts returns the host names of every short domain.
+func (u *URLShortenService) ownHosts() []string {
+	hosts := make([]string, len(u.domains))
+	for i, d := range u.domains {
+		hosts[i] = hostOf(d.base)
+	}
+	return hosts
+}
@@ -0,0 +1,73 @@
+package service
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"urlshortener/internal/database"
+	"urlshortener/internal/entities"
+)
+
+func TestDomainHost(t *testing.T) {
+	assert.Equal(t, "b.co", DomainHost("https://B.co/"))
+	assert.Equal(t, "b.co", DomainHost("https://b.co:443"))
+	assert.Equal(t, "b.co", DomainHost("http://b.co:80"))
+	assert.Equal(t, "b.co:80", DomainHost("https://b.co:80"), "only the scheme's own default port is dropped")
+	assert.Equal(t, "b.co:443", DomainHost("http://b.co:443"))
+	assert.Equal(t, "b.co", DomainHost("b.co"))
+	assert.Equal(t, "b.co:443", DomainHost("b.co:443"), "a bare host has no default port")
+	assert.Equal(t, "localhost:8080", DomainHost("http://localhost:8080"))
+}
+
+// Test that each registered domain has its own codes and duplicate index
+func TestURLShortenService_Domains(t *testing.T) {
+	db := database.NewInMemoryDatabase()
+	app := NewURLShortenService(db, "https://a.co", WithDomains("https://b.co/", "https://a.co"))
+	ctx := context.Background()
+
+	_, err := app.ShortenURL(ctx, entities.ShortenURLRequest{LongURL: "https://www.reddit.com/r/Fedora/", Alias: "abc"})
+	require.NoError(t, err)
+	resp, err := app.ShortenURL(ctx, entities.ShortenURLRequest{LongURL: "https://www.wikipedia.org/", Alias: "abc", Domain: "b.co", Owner: "ci"})
+	require.NoError(t, err, "the alias is free on b.co")
+	assert.Equal(t, "https://b.co/abc", resp.ShortURl)
+	_, err = app.ShortenURL(ctx, entities.ShortenURLRequest{LongURL: "https://www.wikipedia.org/", Alias: "abc", Domain: "https://B.co", Owner: "ci"})
+	assert.NoError(t, err, "repeating the alias on the same domain is idempotent")
+
+	_, err = app.ShortenURL(ctx, entities.ShortenURLRequest{LongURL: "https://www.wikipedia.org/", Domain: "https://c.co"})
+	assert.ErrorIs(t, err, ErrUnknownDomain)
+
+	a, err := app.RedirectURL(ctx, app.HostKey("a.co", "abc"))
+	require.NoError(t, err)
+	assert.Equal(t, "https://www.reddit.com/r/Fedora/", a.LongURl)
+	b, err := app.RedirectURL(ctx, app.HostKey("B.CO", "abc"))
+	require.NoError(t, err)
+	assert.Equal(t, "https://www.wikipedia.org/", b.LongURl)
+	unknown, err := app.RedirectURL(ctx, app.HostKey("10.0.0.1:8080", "abc"))
+	require.NoError(t, err, "unregistered hosts fall back to the default domain")
+	assert.Equal(t, a.LongURl, unknown.LongURl)
+
+	// generated codes are deduplicated per domain
+	onA, err := app.ShortenURL(ctx, entities.ShortenURLRequest{LongURL: "https://www.amazon.com/"})
+	require.NoError(t, err)
+	onB, err := app.ShortenURL(ctx, entities.ShortenURLRequest{LongURL: "https://www.amazon.com/", Domain: "b.co"})
+	require.NoError(t, err)
+	assert.Equal(t, entities.LinkCreated, onB.Status)
+	assert.Equal(t, onA.ShortURl[len("https://a.co/"):], onB.ShortURl[len("https://b.co/"):], "the same hash lives in both namespaces")
+	again, err := app.ShortenURL(ctx, entities.ShortenURLRequest{LongURL: "https://www.amazon.com/", Domain: "b.co"})
+	require.NoError(t, err)
+	assert.Equal(t, entities.LinkExisting, again.Status)
+	assert.Equal(t, 4, db.CountLinks(ctx))
+
+	key, err := app.LinkKey("https://b.co", "abc")
+	require.NoError(t, err)
+	link, err := app.GetLink(ctx, key, "ci")
+	require.NoError(t, err)
+	assert.Equal(t, "https://b.co/abc", link.ShortURL)
+	assert.Equal(t, "abc", link.Code)
+	key, err = app.LinkKey("", "abc")
+	require.NoError(t, err)
+	assert.Equal(t, "abc", key)
+	_, err = app.LinkKey("c.co", "abc")
+	assert.ErrorIs(t, err, ErrUnknownDomain)
+}
@@ -0,0 +1,28 @@
+package service
+
+import "errors"
+
+// Errors returned by URLShortenService. Callers should match them with errors.Is,
+// as some are wrapped with extra detail.
+var (
+	ErrInvalidURL      = errors.New("invalid URL")
+	ErrNotFound        = errors.New("short URL not found")
+	ErrExpired         = errors.New("short URL has expired")
+	ErrHashExhausted   = errors.New("could not generate a unique short code")
+	ErrInvalidAlias    = errors.New("alias must be 3-64 characters of letters, digits, '-' or '_'")
+	ErrReservedAlias   = errors.New("alias is reserved")
+	ErrAliasTaken      = errors.New("alias is already in use")
+	ErrInvalidExpiry   = errors.New("expiry must be a future timestamp or a positive ttl such as 36h, 30d or never")
+	ErrExpiryTooLong   = errors.New("expiry exceeds the maximum allowed by the server")
+	ErrInvalidRedirect = errors.New("redirectType must be one of 301, 302, 307 or 308")
+	ErrInvalidLimit    = errors.New("limit must be between 1 and 100")
+	ErrInvalidWindow   = errors.New("window must be one of 1h, 24h, 7d or all")
+	ErrBlockedURL      = errors.New("URL is not allowed")
+	ErrDisabled        = errors.New("short URL has been disabled")
+	ErrForbidden       = errors.New("short URL belongs to another API key")
+	ErrUnauthenticated = errors.New("an API key is required to manage short URLs")
+	ErrTooManyItems    = errors.New("bulk request exceeds the maximum number of items")
+	ErrUnknownDomain   = errors.New("domain is not served by this shortener")
+	// ErrScreeningUnavailable means the reputation service could not vouch for the URL.
+	ErrScreeningUnavailable = errors.New("URL screening is unavailable")
+)
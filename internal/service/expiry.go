@@ -0,0 +1,71 @@
+package service
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"urlshortener/internal/entities"
+)
+
+// NeverExpires is the TTL value that requests a link without expiry.
+const NeverExpires = "never"
+
+const DefaultExpiry = 7 * 24 * time.Hour
+
+// maxTTLDays is the largest day count a time.Duration can hold.
+const maxTTLDays = math.MaxInt64 / int64(24*time.Hour)
+
+// ParseTTL parses a Go duration with an additional "d" (days) unit, e.g. "90m", "36h" or "30d".
+func ParseTTL(ttl string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(ttl, "d"); ok {
+		n, err := strconv.ParseInt(days, 10, 64)
+		if err != nil || n < 0 || n > maxTTLDays {
+			return 0, ErrInvalidExpiry
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(ttl)
+	if err != nil {
+		return 0, ErrInvalidExpiry
+	}
+	return d, nil
+}
+
+// resolveExpiry works out the expiry of a new link from the request. A zero
+// time means the link never expires.
+func (u *URLShortenService) resolveExpiry(request entities.ShortenURLRequest, now time.Time) (time.Time, error) {
+	if request.ExpiresAt != nil && request.TTL != "" {
+		return time.Time{}, ErrInvalidExpiry
+	}
+	var expiry time.Time
+	switch {
+	case request.TTL == NeverExpires:
+		if u.maxExpiry > 0 {
+			return time.Time{}, ErrExpiryTooLong
+		}
+		return time.Time{}, nil
+	case request.TTL != "":
+		ttl, err := ParseTTL(request.TTL)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if ttl <= 0 {
+			return time.Time{}, ErrInvalidExpiry
+		}
+		expiry = now.Add(ttl)
+	case request.ExpiresAt != nil:
+		if !request.ExpiresAt.After(now) {
+			return time.Time{}, ErrInvalidExpiry
+		}
+		expiry = *request.ExpiresAt
+	case u.defaultExpiry > 0:
+		expiry = now.Add(u.defaultExpiry)
+	default:
+		return time.Time{}, nil
+	}
+	if u.maxExpiry > 0 && expiry.Sub(now) > u.maxExpiry {
+		return time.Time{}, ErrExpiryTooLong
+	}
+	return expiry, nil
+}
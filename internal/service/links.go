@@ -0,0 +1,105 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+	"urlshortener/internal/database"
+	"urlshortener/internal/entities"
+)
+
+// ownedLink returns the link of code when owner, the API key of the caller,
+// created it. Links created without authentication have no owner and cannot
+// be managed at all.
+func (u *URLShortenService) ownedLink(ctx context.Context, code, owner string) (*entities.ShortURLDBData, error) {
+	if owner == "" {
+		return nil, ErrUnauthenticated
+	}
+	data := u.db.RetrieveData(ctx, code)
+	if data == nil {
+		return nil, ErrNotFound
+	}
+	if data.Owner != owner {
+		return nil, ErrForbidden
+	}
+	return data, nil
+}
+
+// GetLink returns the metadata of a link, expired and disabled ones included.
+func (u *URLShortenService) GetLink(ctx context.Context, code, owner string) (*entities.LinkResponse, error) {
+	data, err := u.ownedLink(ctx, code, owner)
+	if err != nil {
+		return nil, err
+	}
+	return u.linkResponse(data), nil
+}
+
+// UpdateLink retargets, re-expires, or disables/enables a link. The new long
+// URL goes through the same validation and policy as a new link, and a new
+// expiry is counted from now.
+func (u *URLShortenService) UpdateLink(ctx context.Context, code, owner string, request entities.UpdateLinkRequest) (*entities.LinkResponse, error) {
+	data, err := u.ownedLink(ctx, code, owner)
+	if err != nil {
+		return nil, err
+	}
+	if request.LongURL != nil {
+		URL, err := u.parseLongURL(*request.LongURL)
+		if err != nil {
+			return nil, err
+		}
+		if err := u.policy.Check(ctx, URL, u.ownHosts()...); err != nil {
+			return nil, err
+		}
+		data.LongURL = URL.String()
+		data.LongURLDomain = URL.Host
+	}
+	if request.ExpiresAt != nil || request.TTL != "" {
+		expiry, err := u.resolveExpiry(entities.ShortenURLRequest{ExpiresAt: request.ExpiresAt, TTL: request.TTL}, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		data.ExpiryDate = expiry
+	}
+	if request.RedirectType != nil {
+		if !ValidRedirectStatus(*request.RedirectType) {
+			return nil, ErrInvalidRedirect
+		}
+		data.RedirectType = *request.RedirectType
+	}
+	if request.Disabled != nil {
+		data.Disabled = *request.Disabled
+	}
+	if err := u.db.UpdateData(ctx, code, *data); err != nil {
+		if errors.Is(err, database.ErrKeyNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return u.linkResponse(data), nil
+}
+
+// DeleteLink removes a link and its analytics; its code becomes free again.
+func (u *URLShortenService) DeleteLink(ctx context.Context, code, owner string) error {
+	if _, err := u.ownedLink(ctx, code, owner); err != nil {
+		return err
+	}
+	err := u.db.DeleteData(ctx, code)
+	if errors.Is(err, database.ErrKeyNotFound) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (u *URLShortenService) linkResponse(data *entities.ShortURLDBData) *entities.LinkResponse {
+	return &entities.LinkResponse{
+		ShortURL:     u.shortURLOf(data),
+		Code:         data.ShortURl,
+		LongURL:      data.LongURL,
+		CreatedAt:    data.CreatedAt,
+		ExpiryDate:   data.ExpiryDate,
+		Expired:      data.Expired(time.Now()),
+		RedirectType: u.redirectStatus(data),
+		Disabled:     data.Disabled,
+		Owner:        data.Owner,
+	}
+}
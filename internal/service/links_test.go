@@ -0,0 +1,174 @@
+package service
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"urlshortener/internal/database"
+	"urlshortener/internal/entities"
+)
+
+func newLinkTestService(t *testing.T) (*URLShortenService, database.DB) {
+	t.Helper()
+	db := database.NewInMemoryDatabase()
+	app := NewURLShortenService(db, "https://sho.rt", WithURLPolicy(URLPolicy{Deny: []string{"evil.com"}}))
+	_, err := app.ShortenURL(context.Background(), entities.ShortenURLRequest{LongURL: "https://www.reddit.com/r/Fedora/", Alias: "fedora", Owner: "ci"})
+	require.NoError(t, err)
+	return app, db
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+// Test fetching link metadata and the ownership rules
+func TestURLShortenService_GetLink(t *testing.T) {
+	app, _ := newLinkTestService(t)
+	ctx := context.Background()
+	link, err := app.GetLink(ctx, "fedora", "ci")
+	require.NoError(t, err)
+	assert.Equal(t, "https://sho.rt/fedora", link.ShortURL)
+	assert.Equal(t, "fedora", link.Code)
+	assert.Equal(t, "https://www.reddit.com/r/Fedora/", link.LongURL)
+	assert.Equal(t, http.StatusPermanentRedirect, link.RedirectType)
+	assert.Equal(t, "ci", link.Owner)
+	assert.False(t, link.Expired)
+
+	_, err = app.GetLink(ctx, "fedora", "ops")
+	assert.ErrorIs(t, err, ErrForbidden)
+	_, err = app.GetLink(ctx, "NOPE42", "ci")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	_, err = app.GetLink(ctx, "fedora", "")
+	assert.ErrorIs(t, err, ErrUnauthenticated)
+
+	// links created without authentication cannot be managed by anyone
+	_, err = app.ShortenURL(ctx, entities.ShortenURLRequest{LongURL: "https://www.wikipedia.org/", Alias: "wiki"})
+	require.NoError(t, err)
+	_, err = app.GetLink(ctx, "wiki", "ops")
+	assert.ErrorIs(t, err, ErrForbidden)
+	_, err = app.GetLink(ctx, "wiki", "")
+	assert.ErrorIs(t, err, ErrUnauthenticated)
+}
+
+// Test retargeting, re-expiring and disabling a link
+func TestURLShortenService_UpdateLink(t *testing.T) {
+	app, db := newLinkTestService(t)
+	ctx := context.Background()
+
+	link, err := app.UpdateLink(ctx, "fedora", "ci", entities.UpdateLinkRequest{LongURL: ptr("https://www.wikipedia.org/wiki/Fedora"), TTL: "1h", RedirectType: ptr(http.StatusFound)})
+	require.NoError(t, err)
+	assert.Equal(t, "https://www.wikipedia.org/wiki/Fedora", link.LongURL)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), link.ExpiryDate, time.Minute)
+	assert.Equal(t, http.StatusFound, link.RedirectType)
+	stored := db.RetrieveData(ctx, "fedora")
+	assert.Equal(t, "www.wikipedia.org", stored.LongURLDomain)
+	assert.Equal(t, "", db.RetrieveDuplicateURL(ctx, "https://www.reddit.com/r/Fedora/"))
+
+	resp, err := app.RedirectURL(ctx, "fedora")
+	require.NoError(t, err)
+	assert.Equal(t, "https://www.wikipedia.org/wiki/Fedora", resp.LongURl)
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+
+	// disabling stops redirects; the original URL then gets a fresh code
+	link, err = app.UpdateLink(ctx, "fedora", "ci", entities.UpdateLinkRequest{Disabled: ptr(true)})
+	require.NoError(t, err)
+	assert.True(t, link.Disabled)
+	_, err = app.RedirectURL(ctx, "fedora")
+	assert.ErrorIs(t, err, ErrDisabled)
+	created, err := app.ShortenURL(ctx, entities.ShortenURLRequest{LongURL: "https://www.wikipedia.org/wiki/Fedora", Owner: "ci"})
+	require.NoError(t, err)
+	assert.Equal(t, entities.LinkReissued, created.Status)
+	_, err = app.UpdateLink(ctx, "fedora", "ci", entities.UpdateLinkRequest{Disabled: ptr(false)})
+	require.NoError(t, err)
+	_, err = app.RedirectURL(ctx, "fedora")
+	assert.NoError(t, err)
+
+	// a clear expiry
+	link, err = app.UpdateLink(ctx, "fedora", "ci", entities.UpdateLinkRequest{TTL: NeverExpires})
+	require.NoError(t, err)
+	assert.True(t, link.ExpiryDate.IsZero())
+
+	tests := []struct {
+		name    string
+		owner   string
+		request entities.UpdateLinkRequest
+		want    error
+	}{
+		{name: "other owner", owner: "ops", request: entities.UpdateLinkRequest{Disabled: ptr(true)}, want: ErrForbidden},
+		{name: "invalid URL", owner: "ci", request: entities.UpdateLinkRequest{LongURL: ptr("not a url")}, want: ErrInvalidURL},
+		{name: "blocked URL", owner: "ci", request: entities.UpdateLinkRequest{LongURL: ptr("https://evil.com/")}, want: ErrBlockedURL},
+		{name: "loop", owner: "ci", request: entities.UpdateLinkRequest{LongURL: ptr("https://sho.rt/other")}, want: ErrBlockedURL},
+		{name: "past expiry", owner: "ci", request: entities.UpdateLinkRequest{ExpiresAt: ptr(time.Now().Add(-time.Hour))}, want: ErrInvalidExpiry},
+		{name: "bad redirect", owner: "ci", request: entities.UpdateLinkRequest{RedirectType: ptr(http.StatusOK)}, want: ErrInvalidRedirect},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := app.UpdateLink(ctx, "fedora", tt.owner, tt.request)
+			assert.ErrorIs(t, err, tt.want)
+			assert.Equal(t, "https://www.wikipedia.org/wiki/Fedora", db.RetrieveData(ctx, "fedora").LongURL, "rejected updates change nothing")
+		})
+	}
+}
+
+// Test deleting a link frees its code
+func TestURLShortenService_DeleteLink(t *testing.T) {
+	app, db := newLinkTestService(t)
+	ctx := context.Background()
+	assert.ErrorIs(t, app.DeleteLink(ctx, "fedora", "ops"), ErrForbidden)
+	require.NoError(t, app.DeleteLink(ctx, "fedora", "ci"))
+	assert.Nil(t, db.RetrieveData(ctx, "fedora"))
+	assert.ErrorIs(t, app.DeleteLink(ctx, "fedora", "ci"), ErrNotFound)
+	_, err := app.RedirectURL(ctx, "fedora")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	_, err = app.ShortenURL(ctx, entities.ShortenURLRequest{LongURL: "https://www.wikipedia.org/", Alias: "fedora", Owner: "ops"})
+	assert.NoError(t, err)
+}
+
+// Test that API keys never share a link, so one cannot retarget the links
+// another hands out
+func TestURLShortenService_LinksPerOwner(t *testing.T) {
+	for _, store := range database.Stores {
+		t.Run(store, func(t *testing.T) {
+			db, err := database.Open(store, filepath.Join(t.TempDir(), "urls.db"))
+			require.NoError(t, err)
+			if closer, ok := db.(io.Closer); ok {
+				t.Cleanup(func() { _ = closer.Close() })
+			}
+			app := NewURLShortenService(db, "https://sho.rt")
+			ctx := context.Background()
+			shorten := func(owner string) (string, string) {
+				resp, err := app.ShortenURL(ctx, entities.ShortenURLRequest{LongURL: "https://example.com/x", Owner: owner})
+				require.NoError(t, err)
+				return strings.TrimPrefix(resp.ShortURl, "https://sho.rt/"), resp.Status
+			}
+
+			alice, _ := shorten("alice")
+			bob, status := shorten("bob")
+			assert.NotEqual(t, alice, bob)
+			assert.Equal(t, entities.LinkCreated, status)
+			again, status := shorten("bob")
+			assert.Equal(t, bob, again, "a key still reuses its own link")
+			assert.Equal(t, entities.LinkExisting, status)
+			_, err = app.GetLink(ctx, bob, "bob")
+			assert.NoError(t, err)
+			_, err = app.LinkStats(ctx, bob, "bob")
+			assert.NoError(t, err)
+
+			_, err = app.UpdateLink(ctx, alice, "alice", entities.UpdateLinkRequest{LongURL: ptr("https://example.com/y")})
+			require.NoError(t, err)
+			resp, err := app.RedirectURL(ctx, bob)
+			require.NoError(t, err)
+			assert.Equal(t, "https://example.com/x", resp.LongURl, "retargeting alice's link leaves bob's alone")
+			again, _ = shorten("bob")
+			assert.Equal(t, bob, again)
+		})
+	}
+}
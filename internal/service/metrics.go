@@ -0,0 +1,30 @@
+package service
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"urlshortener/internal/database"
+)
+
+// serviceMetrics are the Prometheus metrics exported by the service.
+type serviceMetrics struct {
+	linksCreated prometheus.Counter
+	redirects    prometheus.Counter
+	collisions   prometheus.Counter
+}
+
+func newServiceMetrics(reg prometheus.Registerer, db database.DB) *serviceMetrics {
+	factory := promauto.With(reg)
+	factory.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "urlshortener_links",
+		Help: "Links currently held by the store, expired ones included.",
+	}, func() float64 {
+		return float64(db.CountLinks(context.Background()))
+	})
+	return &serviceMetrics{
+		linksCreated: factory.NewCounter(prometheus.CounterOpts{Name: "urlshortener_links_created_total", Help: "Short links created."}),
+		redirects:    factory.NewCounter(prometheus.CounterOpts{Name: "urlshortener_redirects_total", Help: "Redirects served."}),
+		collisions:   factory.NewCounter(prometheus.CounterOpts{Name: "urlshortener_hash_collisions_total", Help: "Short code collisions hit while generating codes."}),
+	}
+}
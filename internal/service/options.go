@@ -0,0 +1,112 @@
+package service
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"net/http"
+	"time"
+)
+
+// Option customises a URLShortenService at construction time.
+type Option func(*URLShortenService)
+
+// WithDefaultExpiry sets the lifetime of links created without an explicit
+// expiry; zero means such links never expire.
+func WithDefaultExpiry(d time.Duration) Option {
+	return func(u *URLShortenService) {
+		u.defaultExpiry = d
+	}
+}
+
+// WithMaxExpiry caps how far in the future a link may expire; zero means no cap.
+// With a cap in place non-expiring links are refused.
+func WithMaxExpiry(d time.Duration) Option {
+	return func(u *URLShortenService) {
+		u.maxExpiry = d
+	}
+}
+
+// WithReapInterval sets how often expired links are purged from the store.
+func WithReapInterval(d time.Duration) Option {
+	return func(u *URLShortenService) {
+		u.reapInterval = d
+	}
+}
+
+// WithTopDomainsInterval sets how often the top domains ranking is refreshed.
+func WithTopDomainsInterval(d time.Duration) Option {
+	return func(u *URLShortenService) {
+		u.topDomainsInterval = d
+	}
+}
+
+// WithCodeLength sets the initial length of generated short codes, between
+// MinCodeLength and UpperBoundEncodedLength. Codes still grow on repeated collisions.
+func WithCodeLength(n int) Option {
+	return func(u *URLShortenService) {
+		u.codeLength = n
+	}
+}
+
+// WithCodeGenerator sets the strategy used to mint short codes; see
+// NewCodeGenerator for the built-in ones.
+func WithCodeGenerator(g CodeGenerator) Option {
+	return func(u *URLShortenService) {
+		u.codes = g
+	}
+}
+
+// WithDefaultRedirect sets the redirect status used for links created without
+// an explicit redirectType. It must be one of 301, 302, 307 or 308.
+func WithDefaultRedirect(status int) Option {
+	return func(u *URLShortenService) {
+		u.defaultRedirect = status
+	}
+}
+
+// WithDomains registers short domains served besides the default one, as base
+// URLs such as https://b.co. Each has its own code namespace, and requests
+// naming any other domain are refused.
+func WithDomains(bases ...string) Option {
+	return func(u *URLShortenService) {
+		u.otherDomains = append(u.otherDomains, bases...)
+	}
+}
+
+// WithBulkConcurrency sets how many links of a bulk request are shortened at once.
+func WithBulkConcurrency(n int) Option {
+	return func(u *URLShortenService) {
+		u.bulkConcurrency = n
+	}
+}
+
+// WithURLPolicy sets the allow/deny lists and reputation hook applied to every
+// long URL. Links back to the shortener itself are always refused.
+func WithURLPolicy(p URLPolicy) Option {
+	return func(u *URLShortenService) {
+		u.policy = p
+	}
+}
+
+// WithCanonicalization enables the optional canonicalization steps applied to
+// long URLs before they are deduplicated and stored.
+func WithCanonicalization(c Canonicalization) Option {
+	return func(u *URLShortenService) {
+		u.canonical = c
+	}
+}
+
+// WithMetrics registers the service metrics on reg instead of a private registry.
+func WithMetrics(reg prometheus.Registerer) Option {
+	return func(u *URLShortenService) {
+		u.registry = reg
+	}
+}
+
+// ValidRedirectStatus reports whether status may be used for a short link redirect.
+func ValidRedirectStatus(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
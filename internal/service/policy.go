@@ -0,0 +1,140 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// URLPolicy screens long URLs before they are shortened.
+type URLPolicy struct {
+	// Allow, when not empty, lists the only hosts that may be shortened.
+	// Deny lists hosts that may never be shortened and wins over Allow.
+	// Entries match a host exactly; a "*." prefix matches every subdomain,
+	// so "*.example.com" matches "a.example.com" but not "example.com".
+	Allow []string
+	Deny  []string
+	// AllowPrivate lets links target loopback, private and link-local
+	// addresses, which are refused by default.
+	AllowPrivate bool
+	// DenyIPHosts refuses links whose host is an IP address rather than a name.
+	DenyIPHosts bool
+	// Ports, when not empty, lists the only explicit ports links may use;
+	// URLs without a port are always accepted.
+	Ports []int
+	// Reputation, when set, is consulted last for every URL.
+	Reputation ReputationChecker
+}
+
+// ReputationChecker is the hook for external URL reputation services such as
+// Safe Browsing. Screen returns a non-empty reason when u is known to be
+// malicious; an error means the service could not be consulted.
+type ReputationChecker interface {
+	Screen(ctx context.Context, u *url.URL) (reason string, err error)
+}
+
+// ReputationFunc adapts a function to ReputationChecker, e.g. to stub the
+// reputation service locally.
+type ReputationFunc func(ctx context.Context, u *url.URL) (string, error)
+
+func (f ReputationFunc) Screen(ctx context.Context, u *url.URL) (string, error) {
+	return f(ctx, u)
+}
+
+// ValidateHostPattern reports whether pattern is usable in URLPolicy.Allow or Deny.
+func ValidateHostPattern(pattern string) error {
+	host := strings.TrimPrefix(pattern, "*.")
+	if host == "" || strings.ContainsAny(host, "*/:@ ") || strings.HasPrefix(host, ".") {
+		return fmt.Errorf("invalid host pattern %q, use example.com or *.example.com", pattern)
+	}
+	return nil
+}
+
+// matchHost reports whether host matches one of patterns.
+func matchHost(host string, patterns []string) bool {
+	for _, pattern := range patterns {
+		pattern = normalizeHost(pattern)
+		if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+			if strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// Check applies the policy to u. ownHosts are the hosts of our short domains:
+// a link to them would redirect to ourselves.
+func (p *URLPolicy) Check(ctx context.Context, u *url.URL, ownHosts ...string) error {
+	host := normalizeHost(u.Hostname())
+	for _, own := range ownHosts {
+		if host == normalizeHost(own) {
+			return fmt.Errorf("%w: links to this shortener are not allowed", ErrBlockedURL)
+		}
+	}
+	if matchHost(host, p.Deny) {
+		return fmt.Errorf("%w: %s is on the deny list", ErrBlockedURL, host)
+	}
+	if len(p.Allow) > 0 && !matchHost(host, p.Allow) {
+		return fmt.Errorf("%w: %s is not on the allow list", ErrBlockedURL, host)
+	}
+	if p.DenyIPHosts && net.ParseIP(host) != nil {
+		return fmt.Errorf("%w: %s is an IP address", ErrBlockedURL, host)
+	}
+	if port := u.Port(); port != "" && len(p.Ports) > 0 && !slices.Contains(p.Ports, atoi(port)) {
+		return fmt.Errorf("%w: port %s is not allowed", ErrBlockedURL, port)
+	}
+	if !p.AllowPrivate && isPrivateHost(host) {
+		return fmt.Errorf("%w: %s is a private or loopback address", ErrBlockedURL, host)
+	}
+	if p.Reputation != nil {
+		reason, err := p.Reputation.Screen(ctx, u)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrScreeningUnavailable, err)
+		}
+		if reason != "" {
+			return fmt.Errorf("%w: %s", ErrBlockedURL, reason)
+		}
+	}
+	return nil
+}
+
+// isPrivateHost reports whether host is localhost or an IP literal that is
+// not publicly routable. Host names are not resolved.
+func isPrivateHost(host string) bool {
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast()
+}
+
+// atoi returns the value of a validated port, or 0.
+func atoi(port string) int {
+	n, _ := strconv.Atoi(port)
+	return n
+}
+
+// hostOf returns the host of a base URL such as http://localhost:8080, or ""
+// when it cannot be parsed.
+func hostOf(base string) string {
+	u, err := url.Parse(base)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
@@ -0,0 +1,78 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net/url"
+	"testing"
+)
+
+func TestURLPolicy_Check(t *testing.T) {
+	reputation := ReputationFunc(func(ctx context.Context, u *url.URL) (string, error) {
+		switch u.Hostname() {
+		case "phish.example.org":
+			return "known phishing site", nil
+		case "flaky.example.org":
+			return "", errors.New("timeout")
+		}
+		return "", nil
+	})
+	tests := []struct {
+		name   string
+		policy URLPolicy
+		url    string
+		want   error
+	}{
+		{name: "open policy", url: "https://www.reddit.com/r/Fedora/"},
+		{name: "own domain", url: "http://LOCALHOST:9999/abc", want: ErrBlockedURL},
+		{name: "own domain with trailing dot", url: "https://sho.rt./abc", want: ErrBlockedURL},
+		{name: "denied exactly", policy: URLPolicy{Deny: []string{"evil.com"}}, url: "https://EVIL.com/x", want: ErrBlockedURL},
+		{name: "exact deny spares subdomains", policy: URLPolicy{Deny: []string{"evil.com"}}, url: "https://www.evil.com/x"},
+		{name: "wildcard deny", policy: URLPolicy{Deny: []string{"*.evil.com"}}, url: "https://a.b.evil.com/x", want: ErrBlockedURL},
+		{name: "wildcard spares apex", policy: URLPolicy{Deny: []string{"*.evil.com"}}, url: "https://evil.com/x"},
+		{name: "wildcard is not a substring match", policy: URLPolicy{Deny: []string{"*.evil.com"}}, url: "https://notevil.com/x"},
+		{name: "allowed", policy: URLPolicy{Allow: []string{"*.example.com", "example.com"}}, url: "https://example.com/x"},
+		{name: "not allowed", policy: URLPolicy{Allow: []string{"*.example.com"}}, url: "https://example.net/x", want: ErrBlockedURL},
+		{name: "deny wins over allow", policy: URLPolicy{Allow: []string{"*.example.com"}, Deny: []string{"bad.example.com"}}, url: "https://bad.example.com/x", want: ErrBlockedURL},
+		{name: "loopback v4", url: "http://127.0.0.1/admin", want: ErrBlockedURL},
+		{name: "loopback v6", url: "http://[::1]:8080/", want: ErrBlockedURL},
+		{name: "private", url: "http://10.1.2.3/", want: ErrBlockedURL},
+		{name: "link local metadata", url: "http://169.254.169.254/latest/meta-data/", want: ErrBlockedURL},
+		{name: "unspecified", url: "http://0.0.0.0/", want: ErrBlockedURL},
+		{name: "localhost name", url: "http://api.localhost/", want: ErrBlockedURL},
+		{name: "public ip", url: "http://93.184.216.34/"},
+		{name: "private allowed", policy: URLPolicy{AllowPrivate: true}, url: "http://10.1.2.3/"},
+		{name: "ip host denied", policy: URLPolicy{DenyIPHosts: true}, url: "http://93.184.216.34/", want: ErrBlockedURL},
+		{name: "ipv6 host denied", policy: URLPolicy{DenyIPHosts: true}, url: "http://[2001:db8::1]/", want: ErrBlockedURL},
+		{name: "name allowed without ip hosts", policy: URLPolicy{DenyIPHosts: true}, url: "http://example.com/"},
+		{name: "port allowed", policy: URLPolicy{Ports: []int{8080, 8443}}, url: "https://example.com:8443/"},
+		{name: "port not allowed", policy: URLPolicy{Ports: []int{8443}}, url: "https://example.com:9000/", want: ErrBlockedURL},
+		{name: "default port always allowed", policy: URLPolicy{Ports: []int{8443}}, url: "https://example.com/"},
+		{name: "any port by default", url: "https://example.com:9000/"},
+		{name: "reputation clean", policy: URLPolicy{Reputation: reputation}, url: "https://example.com/"},
+		{name: "reputation malicious", policy: URLPolicy{Reputation: reputation}, url: "https://phish.example.org/login", want: ErrBlockedURL},
+		{name: "reputation down", policy: URLPolicy{Reputation: reputation}, url: "https://flaky.example.org/", want: ErrScreeningUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(tt.url)
+			assert.NoError(t, err)
+			err = tt.policy.Check(context.Background(), u, "localhost", "sho.rt")
+			if tt.want == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateHostPattern(t *testing.T) {
+	for _, ok := range []string{"example.com", "*.example.com", "localhost"} {
+		assert.NoError(t, ValidateHostPattern(ok), ok)
+	}
+	for _, bad := range []string{"", "*.", "*", "a.*.com", "https://example.com", "example.com:80", ".example.com"} {
+		assert.Error(t, ValidateHostPattern(bad), bad)
+	}
+}
@@ -2,15 +2,12 @@ package service
 
 import (
 	"context"
-	"crypto/sha256"
-	"encoding/hex"
 	"errors"
 	"fmt"
-	"github.com/deatil/go-encoding/encoding"
-	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
 	"log"
+	"net/http"
 	"net/url"
-	"regexp"
 	"strings"
 	"time"
 	"urlshortener/internal/database"
@@ -18,138 +15,318 @@ import (
 )
 
 type URLShortenService struct {
-	db database.InMemoryDatabase
+	db            database.DB
+	domain        string
+	defaultExpiry time.Duration
+	maxExpiry     time.Duration
+	reapInterval  time.Duration
+	// redirect status for links created without an explicit redirectType
+	defaultRedirect    int
+	clicks             chan entities.Click // pending analytics, drained by RecordClicks
+	codeLength         int
+	codes              CodeGenerator
+	topDomainsInterval time.Duration
+	bulkConcurrency    int
+	policy             URLPolicy
+	canonical          Canonicalization
+	otherDomains       []string      // extra short domains, set by WithDomains
+	domains            []shortDomain // registry, the default domain first
+	registry           prometheus.Registerer
+	metrics            *serviceMetrics
 }
 
-const UpperBoundLengthHash = 32
 const UpperBoundEncodedLength = 10
 const UpperBoundHashCheck = 3
 
-var re = regexp.MustCompile("^https?:\\/\\/[a-zA-Z0-9.-]+\\.[a-zA-Z]{2,}(\\/.*)?$")
-var FixDomain string
+// Bounds of the configurable length of generated short codes.
+const MinCodeLength = 4
+const DefaultCodeLength = 6
 
-func NewURLShortenService(db database.InMemoryDatabase, domain string) *URLShortenService {
-	FixDomain = domain
-	return &URLShortenService{db: db}
+// NewURLShortenService builds the service on top of any DB implementation;
+// domain is the public base URL used when a request does not name one.
+func NewURLShortenService(db database.DB, domain string, opts ...Option) *URLShortenService {
+	u := &URLShortenService{
+		db:                 db,
+		domain:             domain,
+		defaultExpiry:      DefaultExpiry,
+		reapInterval:       DefaultReapInterval,
+		defaultRedirect:    http.StatusPermanentRedirect,
+		clicks:             make(chan entities.Click, clickBufferSize),
+		codeLength:         DefaultCodeLength,
+		codes:              HashGenerator{},
+		topDomainsInterval: DefaultTopDomainsInterval,
+		bulkConcurrency:    DefaultBulkConcurrency,
+	}
+	for _, opt := range opts {
+		opt(u)
+	}
+	u.domains = newDomains(u.domain, u.otherDomains)
+	if u.registry == nil {
+		u.registry = prometheus.NewRegistry()
+	}
+	u.metrics = newServiceMetrics(u.registry, db)
+	return u
 }
 
 type URLShortener interface {
 	ShortenURL(ctx context.Context, request entities.ShortenURLRequest) (*entities.ShortenURLResponse, error)
-	RedirectURL(ctx context.Context, data string) *entities.RedirectShortURLResponse
+	RedirectURL(ctx context.Context, data string) (*entities.RedirectShortURLResponse, error)
 	GenerateHashOfURL(ctx context.Context, URL string) string
 }
 
 func (u *URLShortenService) ShortenURL(ctx context.Context, request entities.ShortenURLRequest) (*entities.ShortenURLResponse, error) {
-	// check if it's a valid url
-	URL, err := url.ParseRequestURI(request.LongURL)
+	URL, err := u.parseLongURL(request.LongURL)
 	if err != nil {
 		return nil, err
 	}
-	if URL.Scheme != "http" && URL.Scheme != "https" {
-		URL.Scheme = "https"
+	if request.RedirectType != 0 && !ValidRedirectStatus(request.RedirectType) {
+		return nil, ErrInvalidRedirect
 	}
-	if URL.Host == "" {
-		return nil, errors.New("Invalid URL")
+	domain, err := u.resolveDomain(request.Domain)
+	if err != nil {
+		return nil, err
 	}
-	if !re.MatchString(URL.String()) {
-		return nil, errors.New("Invalid URL")
+	if err := u.policy.Check(ctx, URL, u.ownHosts()...); err != nil {
+		return nil, err
 	}
-	res := u.db.RetrieveDuplicateURL(ctx, URL.String())
-	if res == "" {
-		hash := u.GenerateHashOfURL(ctx, URL.String())
-		if hash == "" {
-			log.Printf("Could not generate short url due to unavailability of hash for long URL: %s", URL.String())
-			return nil, errors.New("Service Unavailable Could not generate Hash ")
-		}
-		var shortURL string
-		if request.Domain == "" {
-			shortURL = fmt.Sprintf("%s/%s", FixDomain, hash)
-		} else {
-			shortURL = fmt.Sprintf("%s/%s", request.Domain, hash)
-		}
-		response := entities.ShortenURLResponse{
-			ShortURl:   shortURL,
-			CreatedAt:  time.Now(),
-			ExpiryDate: time.Now().AddDate(0, 0, 7),
-		}
-		domain := FixDomain
-		if request.Domain != "" {
-			domain = request.Domain
+	if request.Alias != "" {
+		return u.shortenWithAlias(ctx, request, URL, domain)
+	}
+	for attempt := 0; ; attempt++ {
+		resp, err := u.shortenGenerated(ctx, request, URL, domain)
+		// a concurrent request took the code between generating and storing
+		// it: generate another
+		if errors.Is(err, database.ErrURLAlreadyShortened) && attempt < UpperBoundHashCheck {
+			continue
 		}
-		dbData := entities.ShortURLDBData{
-			LongURL:       request.LongURL,
-			Domain:        domain,
-			LongURLDomain: URL.Host,
-			ShortURl:      hash,
-			CreatedAt:     response.CreatedAt,
-			ExpiryDate:    response.ExpiryDate,
+		return resp, err
+	}
+}
+
+// shortenGenerated returns the live link of URL, or stores it under a newly
+// generated code. The lookup before generating is only a shortcut: the store
+// decides atomically whether a concurrent request created the link first.
+func (u *URLShortenService) shortenGenerated(ctx context.Context, request entities.ShortenURLRequest, URL *url.URL, domain *shortDomain) (*entities.ShortenURLResponse, error) {
+	status := entities.LinkCreated
+	if res := u.db.RetrieveDuplicateURL(ctx, database.NamespacedKey(domain.namespace, database.OwnedURL(request.Owner, URL.String()))); res != "" {
+		result := u.db.RetrieveData(ctx, res)
+		if result != nil && !result.Expired(time.Now()) && !result.Disabled {
+			return u.toResponse(result, entities.LinkExisting), nil
 		}
-		err := u.db.AddData(ctx, hash, dbData)
-		if err != nil {
-			return nil, err
+		// the old code is dead (expired or disabled); mint a fresh one
+		status = entities.LinkReissued
+	}
+	data, err := u.newLink(request, URL, domain)
+	if err != nil {
+		return nil, err
+	}
+	hash := u.generateCode(ctx, domain.namespace, URL.String())
+	if hash == "" {
+		log.Printf("Could not generate short url due to unavailability of hash for long URL: %s", URL.String())
+		return nil, ErrHashExhausted
+	}
+	data.ShortURl = hash
+	link, created, err := u.db.GetOrCreate(ctx, database.NamespacedKey(domain.namespace, hash), data)
+	if err != nil {
+		return nil, err
+	}
+	if !created {
+		return u.toResponse(link, entities.LinkExisting), nil
+	}
+	u.metrics.linksCreated.Inc()
+	return u.toResponse(link, status), nil
+}
+
+// parseLongURL checks that raw is a valid absolute http(s) URL and returns it
+// in canonical form.
+func (u *URLShortenService) parseLongURL(raw string) (*url.URL, error) {
+	// url.Parse rather than ParseRequestURI, so that a #fragment stays out
+	// of the path and query being canonicalized
+	URL, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidURL, err)
+	}
+	if !URL.IsAbs() {
+		return nil, ErrInvalidURL
+	}
+	if URL.Scheme != "http" && URL.Scheme != "https" {
+		return nil, fmt.Errorf("%w: scheme %q is not http or https", ErrInvalidURL, URL.Scheme)
+	}
+	if URL.Host == "" {
+		return nil, ErrInvalidURL
+	}
+	if err := u.canonical.Canonicalize(URL); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidURL, err)
+	}
+	if err := validateLongURL(URL); err != nil {
+		return nil, err
+	}
+	return URL, nil
+}
+
+// shortenWithAlias stores the link under the caller chosen code. Repeating
+// the same alias for the same (canonical) long URL and owner is idempotent;
+// anything else is a conflict.
+func (u *URLShortenService) shortenWithAlias(ctx context.Context, request entities.ShortenURLRequest, URL *url.URL, domain *shortDomain) (*entities.ShortenURLResponse, error) {
+	if err := ValidateAlias(request.Alias); err != nil {
+		return nil, err
+	}
+	key := database.NamespacedKey(domain.namespace, request.Alias)
+	if existing := u.db.RetrieveData(ctx, key); existing != nil {
+		return u.existingAlias(existing, request, URL)
+	}
+	data, err := u.newLink(request, URL, domain)
+	if err != nil {
+		return nil, err
+	}
+	data.ShortURl = request.Alias
+	err = u.db.AddData(ctx, key, data)
+	if errors.Is(err, database.ErrURLAlreadyShortened) {
+		// a concurrent request took the alias, maybe for the same link
+		if existing := u.db.RetrieveData(ctx, key); existing != nil {
+			return u.existingAlias(existing, request, URL)
 		}
-		return &response, nil
+		return nil, ErrAliasTaken
 	}
-	result := u.db.RetrieveData(ctx, res)
-	if result.Domain == "" {
-		result.ShortURl = fmt.Sprintf("%s/%s", FixDomain, result.ShortURl)
-	} else {
-		result.ShortURl = fmt.Sprintf("%s/%s", result.Domain, result.ShortURl)
+	if err != nil {
+		return nil, err
 	}
-	return &entities.ShortenURLResponse{
-		ShortURl:   result.ShortURl,
-		CreatedAt:  result.CreatedAt,
-		ExpiryDate: result.ExpiryDate,
+	u.metrics.linksCreated.Inc()
+	return u.toResponse(&data, entities.LinkCreated), nil
+}
+
+// existingAlias answers a request for an alias that is already stored.
+func (u *URLShortenService) existingAlias(existing *entities.ShortURLDBData, request entities.ShortenURLRequest, URL *url.URL) (*entities.ShortenURLResponse, error) {
+	// an expired alias stays reserved until the reaper purges it
+	if existing.LongURL == URL.String() && existing.Owner == request.Owner && !existing.Expired(time.Now()) && !existing.Disabled {
+		return u.toResponse(existing, entities.LinkExisting), nil
+	}
+	return nil, ErrAliasTaken
+}
+
+// newLink builds the stored link of a request on domain, without its code.
+func (u *URLShortenService) newLink(request entities.ShortenURLRequest, URL *url.URL, domain *shortDomain) (entities.ShortURLDBData, error) {
+	now := time.Now()
+	expiry, err := u.resolveExpiry(request, now)
+	if err != nil {
+		return entities.ShortURLDBData{}, err
+	}
+	redirectType := request.RedirectType
+	if redirectType == 0 {
+		redirectType = u.defaultRedirect
+	}
+	return entities.ShortURLDBData{
+		LongURL:       URL.String(),
+		Domain:        domain.base,
+		LongURLDomain: URL.Host,
+		CreatedAt:     now,
+		ExpiryDate:    expiry,
+		RedirectType:  redirectType,
+		Owner:         request.Owner,
 	}, nil
 }
 
-// GenerateHashOfURL : hashes long URL with https schema , for hashing it uses sha256, once
-// sha256 sum is obtained first 6 character of sha256 is converted into hexa decimal
-// approximately it returns 6*2 characters in hexa decimal format , this hexa value is base62 encoded.
+func (u *URLShortenService) toResponse(result *entities.ShortURLDBData, status string) *entities.ShortenURLResponse {
+	return &entities.ShortenURLResponse{
+		ShortURl:     u.shortURLOf(result),
+		CreatedAt:    result.CreatedAt,
+		ExpiryDate:   result.ExpiryDate,
+		RedirectType: u.redirectStatus(result),
+		Status:       status,
+	}
+}
+
+// shortURLOf returns the public short URL of a stored link.
+func (u *URLShortenService) shortURLOf(data *entities.ShortURLDBData) string {
+	if data.Domain == "" {
+		return fmt.Sprintf("%s/%s", u.domain, data.ShortURl)
+	}
+	return fmt.Sprintf("%s/%s", data.Domain, data.ShortURl)
+}
+
+// GenerateHashOfURL returns a free short code for URL from the configured
+// CodeGenerator, by default a case-preserving base62 SHA-256 hash of the URL
+// of codeLength (default 6) characters.
 func (u *URLShortenService) GenerateHashOfURL(ctx context.Context, URL string) string {
-	seed := ""
-	hashCheck := 0
-	hashLength := 16
-	encodedLength := 6
-	for {
-		hash := sha256.Sum256([]byte(URL + seed))
-		shortHash := hash[:hashLength]
-		key := hex.EncodeToString(shortHash)
-		encodedData := encoding.FromString(key).Base62Encode().String()
-		encodedValue := strings.ToUpper(encodedData[:encodedLength])
-		err := u.db.CheckDuplicateRequest(ctx, encodedValue)
-		id := uuid.New()
+	return u.generateCode(ctx, "", URL)
+}
+
+// generateCode is GenerateHashOfURL for the code namespace of a short domain.
+// Taken codes and reserved route names count as collisions; after every
+// UpperBoundHashCheck+1 collisions codes get one character longer, up to
+// UpperBoundEncodedLength. It returns "" when no free code was found.
+func (u *URLShortenService) generateCode(ctx context.Context, namespace, URL string) string {
+	length := u.codeLength
+	for attempt := 0; length <= UpperBoundEncodedLength; attempt++ {
+		code, err := u.codes.Generate(ctx, URL, attempt, length)
 		if err != nil {
-			log.Printf("Collision Detected for URL : %v", URL)
-			seed = fmt.Sprintf("%d", time.Now().UnixNano()) + fmt.Sprintf("%s", id.String())
-		} else {
-			return encodedValue
+			log.Printf("Could not generate short code: %s", err)
+			return ""
+		}
+		if !reservedAliases[strings.ToLower(code)] && u.db.CheckDuplicateRequest(ctx, database.NamespacedKey(namespace, code)) == nil {
+			return code
 		}
-		hashCheck++
-		if hashCheck > UpperBoundHashCheck {
-			if hashLength < UpperBoundLengthHash {
-				hashLength++
-			} else {
-				return ""
-			}
-			if encodedLength < UpperBoundEncodedLength {
-				encodedLength++
-			}
+		log.Printf("Collision Detected for URL : %v", URL)
+		u.metrics.collisions.Inc()
+		if (attempt+1)%(UpperBoundHashCheck+1) == 0 {
+			length++
 		}
 	}
+	return ""
 }
 
-func (u *URLShortenService) RedirectURL(ctx context.Context, hash string) *entities.RedirectShortURLResponse {
+// RedirectURL resolves a short code, or the store key returned by HostKey, to its long URL. It fails with
+// ErrNotFound for unknown codes, ErrExpired for links past their expiry and
+// ErrDisabled for disabled links.
+func (u *URLShortenService) RedirectURL(ctx context.Context, hash string) (*entities.RedirectShortURLResponse, error) {
 	resp := u.db.RetrieveData(ctx, hash)
-	if resp != nil && time.Now().Before(resp.ExpiryDate) {
-		return &entities.RedirectShortURLResponse{
-			LongURl: resp.LongURL,
-			Domain:  resp.Domain,
-		}
+	if resp == nil {
+		return nil, ErrNotFound
+	}
+	if resp.Expired(time.Now()) {
+		return nil, ErrExpired
+	}
+	if resp.Disabled {
+		return nil, ErrDisabled
 	}
-	return nil
+	u.metrics.redirects.Inc()
+	return &entities.RedirectShortURLResponse{
+		LongURl:    resp.LongURL,
+		Domain:     resp.Domain,
+		StatusCode: u.redirectStatus(resp),
+	}, nil
 }
 
-func (u *URLShortenService) RetrieveTop3Domains(ctx context.Context) []entities.TopDomains {
-	return u.db.RetrieveTop3Domain(ctx)
+// redirectStatus returns the stored redirect status of a link, falling back to
+// the server default for links stored before redirect types existed.
+func (u *URLShortenService) redirectStatus(data *entities.ShortURLDBData) int {
+	if ValidRedirectStatus(data.RedirectType) {
+		return data.RedirectType
+	}
+	return u.defaultRedirect
+}
+
+const DefaultTopDomainsLimit = 3
+const MaxTopDomainsLimit = 100
+
+// topDomainWindows maps the accepted ?window= values to database.TopDomainWindows.
+var topDomainWindows = map[string]time.Duration{
+	"":    0,
+	"all": 0,
+	"1h":  time.Hour,
+	"24h": 24 * time.Hour,
+	"7d":  7 * 24 * time.Hour,
+}
+
+// RetrieveTopDomains returns the limit domains shortened most within window
+// ("1h", "24h", "7d", or "" / "all" for all time).
+func (u *URLShortenService) RetrieveTopDomains(ctx context.Context, limit int, window string) ([]entities.TopDomains, error) {
+	if limit < 1 || limit > MaxTopDomainsLimit {
+		return nil, ErrInvalidLimit
+	}
+	duration, ok := topDomainWindows[window]
+	if !ok {
+		return nil, ErrInvalidWindow
+	}
+	return u.db.RetrieveTopDomains(ctx, limit, duration), nil
 }
@@ -2,9 +2,18 @@ package service
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"path/filepath"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 	"urlshortener/internal/database"
@@ -14,7 +23,7 @@ import (
 // Test Shortening of URL for valid url
 func TestURLShortenService_ShortenURL_VALIDURL(t *testing.T) {
 	db := database.NewInMemoryDatabase()
-	app := NewURLShortenService(*db, "http://localhost:8080")
+	app := NewURLShortenService(db, "http://localhost:8080")
 	ctx := context.Background()
 	req := entities.ShortenURLRequest{
 		LongURL: "https://www.reddit.com/r/Fedora/",
@@ -27,19 +36,19 @@ func TestURLShortenService_ShortenURL_VALIDURL(t *testing.T) {
 // Test Shortening of URL for in valid url
 func TestURLShortenService_ShortenURL_INVALIDURL(t *testing.T) {
 	db := database.NewInMemoryDatabase()
-	app := NewURLShortenService(*db, "http://localhost:8080")
+	app := NewURLShortenService(db, "http://localhost:8080")
 	ctx := context.Background()
 	req := entities.ShortenURLRequest{
 		LongURL: "https://invalid-url.",
 	}
 	_, err := app.ShortenURL(ctx, req)
-	assert.Error(t, err)
+	assert.ErrorIs(t, err, ErrInvalidURL)
 }
 
 // Test Shortening of URL for empty url
 func TestURLShortenService_ShortenURL_BadRequest(t *testing.T) {
 	db := database.NewInMemoryDatabase()
-	app := NewURLShortenService(*db, "http://localhost:8080")
+	app := NewURLShortenService(db, "http://localhost:8080")
 	ctx := context.Background()
 	req := entities.ShortenURLRequest{
 		LongURL: "",
@@ -51,7 +60,7 @@ func TestURLShortenService_ShortenURL_BadRequest(t *testing.T) {
 // Test Shortening of URL if same url shortened twice
 func TestURLShortenService_ShortenURL_IFSAMELongURLPassed(t *testing.T) {
 	db := database.NewInMemoryDatabase()
-	app := NewURLShortenService(*db, "http://localhost:8080")
+	app := NewURLShortenService(db, "http://localhost:8080")
 	ctx := context.Background()
 	req := entities.ShortenURLRequest{
 		LongURL: "https://www.reddit.com/r/Fedora/",
@@ -64,12 +73,14 @@ func TestURLShortenService_ShortenURL_IFSAMELongURLPassed(t *testing.T) {
 	assert.NotNil(t, resp2)
 	assert.Equal(t, resp.ShortURl, resp2.ShortURl)
 	assert.Equal(t, resp.ExpiryDate, resp2.ExpiryDate)
+	assert.Equal(t, entities.LinkCreated, resp.Status)
+	assert.Equal(t, entities.LinkExisting, resp2.Status)
 }
 
 // Test Shortening of URL for very long url
 func TestURLShortenService_ShortenURL_LongURL(t *testing.T) {
 	db := database.NewInMemoryDatabase()
-	app := NewURLShortenService(*db, "http://localhost:8080")
+	app := NewURLShortenService(db, "http://localhost:8080")
 	ctx := context.Background()
 	req := entities.ShortenURLRequest{
 		LongURL: "https://accounts.google.com/signin/oauth/consent?authuser=1&part=AJi8hAO8Y7aSI6oqSN5ZFgylTOD4-8IHTf--L_vfW1OSSofRtawOX1M9kDBKtErYlCQmc21gn5uS8Zn1Sxgv9-KAhHv5EKWSgsqjN094rNbw-W0JEs1Fa9k36h75095hQ2ApvCv1EIOxioCxU2VkEa_OxDjGTHHLoBtyO_ZoQiTejVkVXFvAfhq0qlwLC7LODsFpGdKulf7y5I-F-ou3bPh7cZWy0yxGVWGJsTsqBXTeoZDWTRViNhjFUV42ayZKT0l1Fh_-MK96Keig_CuJEhitIrGubdXNwofnwFTf7QH2yo7s4xyFy1lDwJzLdDLxXzOdvhNWCNZfS80aVg2pqcVp4ftmUm5bLFN4U8dB-2GNjsUx9SFFiU8PRPCcmvqT4Jq68HojYPsPIG-SW6a_-lPfXAsJBzLc39ammfnREiLrLm6aFio5zA8qfTuRlMjo5l_SSyo1D33AxPbnoFzi81ks-6hokEErhKCIuQUiSGmKCIk71TkN5aA&flowName=GeneralOAuthFlow&as=S-1540822420%3A1738341489393397&client_id=993576537952-o63tbj4issluoheejqdfan468foht25p.apps.googleusercontent.com&pli=1&rapt=AEjHL4PQqC0VtqcT3S19Kv8Ox5Y7I8_pMD_qdtK4S8BK0OcXG9K7GCzD1rircLh9JedQYt79xrSpWVLXsiLKp-eXFjr3UkNkdA#",
@@ -82,7 +93,7 @@ func TestURLShortenService_ShortenURL_LongURL(t *testing.T) {
 // Test Shortening of URL for URL containing chinese character
 func TestURLShortenService_ShortenURL_NonEnglishCharacter(t *testing.T) {
 	db := database.NewInMemoryDatabase()
-	app := NewURLShortenService(*db, "http://localhost:8080")
+	app := NewURLShortenService(db, "http://localhost:8080")
 	ctx := context.Background()
 	req := entities.ShortenURLRequest{
 		LongURL: "https://zh.wikipedia.org/wiki/%E7%99%BE%E5%BA%A6",
@@ -96,7 +107,7 @@ func TestURLShortenService_ShortenURL_NonEnglishCharacter(t *testing.T) {
 func TestURLShortenService_RedirectURL(t *testing.T) {
 	// Shorten a URL
 	db := database.NewInMemoryDatabase()
-	app := NewURLShortenService(*db, "http://localhost:8080")
+	app := NewURLShortenService(db, "http://localhost:8080")
 	ctx := context.Background()
 	req := entities.ShortenURLRequest{
 		LongURL: "https://www.reddit.com/r/Fedora/",
@@ -107,19 +118,21 @@ func TestURLShortenService_RedirectURL(t *testing.T) {
 
 	// Redirect the URL
 	shortURL := strings.Split(resp.ShortURl, "/")
-	response := app.RedirectURL(ctx, shortURL[len(shortURL)-1])
+	response, err := app.RedirectURL(ctx, shortURL[len(shortURL)-1])
+	assert.NoError(t, err)
 	assert.Equal(t, req.LongURL, response.LongURl)
 }
 
 // Test Redirection of URL once shortened
 func TestURLShortenService_RedirectURLNonExistent(t *testing.T) {
 	db := database.NewInMemoryDatabase()
-	app := NewURLShortenService(*db, "http://localhost:8080")
+	app := NewURLShortenService(db, "http://localhost:8080")
 	ctx := context.Background()
 	// Redirect the URL
 	shortURL := strings.Split("https://www.reddit.com/hdjdjknkdnkj", "/")
-	response := app.RedirectURL(ctx, shortURL[len(shortURL)-1])
+	response, err := app.RedirectURL(ctx, shortURL[len(shortURL)-1])
 	assert.Nil(t, response)
+	assert.ErrorIs(t, err, ErrNotFound)
 }
 
 // Test Redirection of URL once if it is not shortened by this application
@@ -127,7 +140,7 @@ func TestURLShortenService_RetrieveTop3Domain(t *testing.T) {
 	// Redirect the URL
 	// Redit - 2
 	db := database.NewInMemoryDatabase()
-	app := NewURLShortenService(*db, "http://localhost:8080")
+	app := NewURLShortenService(db, "http://localhost:8080")
 	ctx := context.Background()
 	req := entities.ShortenURLRequest{
 		LongURL: "https://www.reddit.com/r/Fedora/",
@@ -197,14 +210,15 @@ func TestURLShortenService_RetrieveTop3Domain(t *testing.T) {
 	assert.NotNil(t, resp)
 
 	// Run Cron to populate db
-	go app.PopulateTopDomains()
+	go app.PopulateTopDomains(ctx)
 	time.Sleep(2 * time.Second)
-	dom := app.RetrieveTop3Domains(ctx)
+	dom, err := app.RetrieveTopDomains(ctx, 3, "")
+	assert.NoError(t, err)
 	assert.Len(t, dom, 3)
 	domains := []entities.TopDomains{
-		{"www.amazon.com", 2},
-		{"www.wikepedia.com", 2},
-		{"www.reddit.com", 2},
+		{Domain: "www.amazon.com", Count: 2},
+		{Domain: "www.wikepedia.com", Count: 2},
+		{Domain: "www.reddit.com", Count: 2},
 	}
 
 	// Loop through slice and check if domain matches any in domainsToCheck
@@ -222,9 +236,574 @@ func TestURLShortenService_RetrieveTop3Domain(t *testing.T) {
 func TestTop3Domain(t *testing.T) {
 	// Redirect the URL
 	db := database.NewInMemoryDatabase()
-	app := NewURLShortenService(*db, "http://localhost:8080")
+	app := NewURLShortenService(db, "http://localhost:8080")
 	ctx := context.Background()
 	shortURL := strings.Split("https://www.reddit.com/r", "/")
-	response := app.RedirectURL(ctx, shortURL[len(shortURL)-1])
+	response, err := app.RedirectURL(ctx, shortURL[len(shortURL)-1])
 	assert.Nil(t, response)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+// fakeDB is a minimal DB used to check the service only talks to the store through the interface
+type fakeDB struct {
+	data   map[string]entities.ShortURLDBData
+	long   map[string]string
+	adds   int
+	addErr error
+}
+
+func newFakeDB() *fakeDB {
+	return &fakeDB{data: map[string]entities.ShortURLDBData{}, long: map[string]string{}}
+}
+
+func (f *fakeDB) AddData(ctx context.Context, key string, data entities.ShortURLDBData) error {
+	f.adds++
+	if f.addErr != nil {
+		return f.addErr
+	}
+	f.data[key] = data
+	f.long[data.LongURL] = key
+	return nil
+}
+
+func (f *fakeDB) GetOrCreate(ctx context.Context, key string, data entities.ShortURLDBData) (*entities.ShortURLDBData, bool, error) {
+	if existing, ok := f.data[f.long[data.LongURL]]; ok {
+		return &existing, false, nil
+	}
+	if err := f.AddData(ctx, key, data); err != nil {
+		return nil, false, err
+	}
+	return &data, true, nil
+}
+
+func (f *fakeDB) CheckDuplicateRequest(ctx context.Context, key string) error {
+	if _, ok := f.data[key]; ok {
+		return errors.New("Duplicate Request")
+	}
+	return nil
+}
+
+func (f *fakeDB) RetrieveData(ctx context.Context, key string) *entities.ShortURLDBData {
+	if data, ok := f.data[key]; ok {
+		return &data
+	}
+	return nil
+}
+
+func (f *fakeDB) RetrieveDuplicateURL(ctx context.Context, longURL string) string {
+	return f.long[longURL]
+}
+
+func (f *fakeDB) UpdateData(ctx context.Context, key string, data entities.ShortURLDBData) error {
+	if _, ok := f.data[key]; !ok {
+		return database.ErrKeyNotFound
+	}
+	f.data[key] = data
+	return nil
+}
+
+func (f *fakeDB) DeleteData(ctx context.Context, key string) error {
+	if _, ok := f.data[key]; !ok {
+		return database.ErrKeyNotFound
+	}
+	delete(f.data, key)
+	return nil
+}
+
+func (f *fakeDB) RetrieveTopDomains(ctx context.Context, limit int, window time.Duration) []entities.TopDomains {
+	return nil
+}
+
+func (f *fakeDB) PopulateTopDomains(ctx context.Context, now time.Time) {}
+
+func (f *fakeDB) PurgeExpired(ctx context.Context, now time.Time) int {
+	return 0
+}
+
+func (f *fakeDB) CountLinks(ctx context.Context) int {
+	return len(f.data)
+}
+
+func (f *fakeDB) ReserveSequence(ctx context.Context, n uint64) (uint64, error) {
+	return 0, nil
+}
+
+func (f *fakeDB) RecordClicks(ctx context.Context, clicks []entities.Click) error {
+	return nil
+}
+
+func (f *fakeDB) RetrieveClickStats(ctx context.Context, key string) *entities.ClickStats {
+	return nil
+}
+
+// Test that the service writes through an injected DB implementation
+func TestURLShortenService_UsesInjectedDB(t *testing.T) {
+	db := newFakeDB()
+	app := NewURLShortenService(db, "https://sho.rt")
+	ctx := context.Background()
+	resp, err := app.ShortenURL(ctx, entities.ShortenURLRequest{LongURL: "https://www.reddit.com/r/Fedora/"})
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(resp.ShortURl, "https://sho.rt/"))
+	assert.Equal(t, 1, db.adds)
+
+	code := db.RetrieveDuplicateURL(ctx, "https://www.reddit.com/r/Fedora/")
+	redirect, err := app.RedirectURL(ctx, code)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://www.reddit.com/r/Fedora/", redirect.LongURl)
+}
+
+// Test that store failures surface from ShortenURL
+func TestURLShortenService_ShortenURL_DBError(t *testing.T) {
+	db := newFakeDB()
+	db.addErr = errors.New("disk full")
+	app := NewURLShortenService(db, "https://sho.rt")
+	_, err := app.ShortenURL(context.Background(), entities.ShortenURLRequest{LongURL: "https://www.reddit.com/r/Fedora/"})
+	assert.EqualError(t, err, "disk full")
+}
+
+// Test that services built on separate stores do not share state or domain
+func TestURLShortenService_IndependentInstances(t *testing.T) {
+	ctx := context.Background()
+	first := NewURLShortenService(database.NewInMemoryDatabase(), "https://one.rt")
+	second := NewURLShortenService(database.NewInMemoryDatabase(), "https://two.rt")
+	req := entities.ShortenURLRequest{LongURL: "https://www.reddit.com/r/Fedora/"}
+	resp, err := first.ShortenURL(ctx, req)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(resp.ShortURl, "https://one.rt/"))
+	code := resp.ShortURl[len("https://one.rt/"):]
+	_, err = second.RedirectURL(ctx, code)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+// Test Shortening of URL with a custom alias and redirecting through it
+func TestURLShortenService_ShortenURL_Alias(t *testing.T) {
+	db := database.NewInMemoryDatabase()
+	app := NewURLShortenService(db, "http://localhost:8080")
+	ctx := context.Background()
+	req := entities.ShortenURLRequest{
+		LongURL: "https://www.reddit.com/r/Fedora/",
+		Alias:   "spring-sale",
+	}
+	resp, err := app.ShortenURL(ctx, req)
+	assert.NoError(t, err)
+	assert.Equal(t, "http://localhost:8080/spring-sale", resp.ShortURl)
+	redirect, err := app.RedirectURL(ctx, "spring-sale")
+	assert.NoError(t, err)
+	assert.Equal(t, req.LongURL, redirect.LongURl)
+
+	// same alias for the same URL is idempotent
+	resp2, err := app.ShortenURL(ctx, req)
+	assert.NoError(t, err)
+	assert.Equal(t, resp.ShortURl, resp2.ShortURl)
+
+	// generated codes never reuse a taken alias
+	assert.Error(t, db.CheckDuplicateRequest(ctx, "spring-sale"))
+}
+
+// Test that an alias owned by another URL is a conflict
+func TestURLShortenService_ShortenURL_AliasTaken(t *testing.T) {
+	db := database.NewInMemoryDatabase()
+	app := NewURLShortenService(db, "http://localhost:8080")
+	ctx := context.Background()
+	_, err := app.ShortenURL(ctx, entities.ShortenURLRequest{LongURL: "https://www.reddit.com/r/Fedora/", Alias: "promo"})
+	assert.NoError(t, err)
+	_, err = app.ShortenURL(ctx, entities.ShortenURLRequest{LongURL: "https://www.amazon.com/deals", Alias: "promo"})
+	assert.ErrorIs(t, err, ErrAliasTaken)
+}
+
+func TestValidateAlias(t *testing.T) {
+	tests := []struct {
+		alias string
+		err   error
+	}{
+		{"spring-sale", nil},
+		{"Spring_Sale_2025", nil},
+		{"abc", nil},
+		{"ab", ErrInvalidAlias},
+		{strings.Repeat("a", MaxAliasLength+1), ErrInvalidAlias},
+		{"has space", ErrInvalidAlias},
+		{"slash/path", ErrInvalidAlias},
+		{"émoji", ErrInvalidAlias},
+		{"shortURL", ErrReservedAlias},
+		{"METRICS", ErrReservedAlias},
+	}
+	for _, tt := range tests {
+		t.Run(tt.alias, func(t *testing.T) {
+			assert.ErrorIs(t, ValidateAlias(tt.alias), tt.err)
+		})
+	}
+}
+
+// Test that requested expiries are stored and honoured on redirect
+func TestURLShortenService_ShortenURL_Expiry(t *testing.T) {
+	ctx := context.Background()
+	future := time.Now().Add(3 * time.Hour).UTC()
+	tests := []struct {
+		name  string
+		req   entities.ShortenURLRequest
+		opts  []Option
+		err   error
+		check func(t *testing.T, resp *entities.ShortenURLResponse)
+	}{
+		{
+			name: "default is seven days",
+			check: func(t *testing.T, resp *entities.ShortenURLResponse) {
+				assert.WithinDuration(t, time.Now().Add(DefaultExpiry), resp.ExpiryDate, time.Minute)
+			},
+		},
+		{
+			name: "configured default",
+			opts: []Option{WithDefaultExpiry(time.Hour)},
+			check: func(t *testing.T, resp *entities.ShortenURLResponse) {
+				assert.WithinDuration(t, time.Now().Add(time.Hour), resp.ExpiryDate, time.Minute)
+			},
+		},
+		{
+			name: "ttl in days",
+			req:  entities.ShortenURLRequest{TTL: "30d"},
+			check: func(t *testing.T, resp *entities.ShortenURLResponse) {
+				assert.WithinDuration(t, time.Now().AddDate(0, 0, 30), resp.ExpiryDate, time.Minute)
+			},
+		},
+		{
+			name: "absolute timestamp",
+			req:  entities.ShortenURLRequest{ExpiresAt: &future},
+			check: func(t *testing.T, resp *entities.ShortenURLResponse) {
+				assert.True(t, future.Equal(resp.ExpiryDate))
+			},
+		},
+		{
+			name: "never",
+			req:  entities.ShortenURLRequest{TTL: NeverExpires},
+			check: func(t *testing.T, resp *entities.ShortenURLResponse) {
+				assert.True(t, resp.ExpiryDate.IsZero())
+			},
+		},
+		{name: "never refused under a cap", req: entities.ShortenURLRequest{TTL: NeverExpires}, opts: []Option{WithMaxExpiry(24 * time.Hour)}, err: ErrExpiryTooLong},
+		{name: "ttl above cap", req: entities.ShortenURLRequest{TTL: "48h"}, opts: []Option{WithMaxExpiry(24 * time.Hour)}, err: ErrExpiryTooLong},
+		{name: "garbage ttl", req: entities.ShortenURLRequest{TTL: "soon"}, err: ErrInvalidExpiry},
+		{name: "negative ttl", req: entities.ShortenURLRequest{TTL: "-1h"}, err: ErrInvalidExpiry},
+		{name: "negative days", req: entities.ShortenURLRequest{TTL: "-1d"}, err: ErrInvalidExpiry},
+		// 213504 days wrap around to about 25 minutes, under any cap
+		{name: "overflowing days", req: entities.ShortenURLRequest{TTL: "213504d"}, opts: []Option{WithMaxExpiry(time.Hour)}, err: ErrInvalidExpiry},
+		{name: "overflowing days uncapped", req: entities.ShortenURLRequest{TTL: "99999999999d"}, err: ErrInvalidExpiry},
+		{name: "longest days under a cap", req: entities.ShortenURLRequest{TTL: "106751d"}, opts: []Option{WithMaxExpiry(time.Hour)}, err: ErrExpiryTooLong},
+		{name: "past timestamp", req: entities.ShortenURLRequest{ExpiresAt: &time.Time{}}, err: ErrInvalidExpiry},
+		{name: "both ttl and timestamp", req: entities.ShortenURLRequest{TTL: "1h", ExpiresAt: &future}, err: ErrInvalidExpiry},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := NewURLShortenService(database.NewInMemoryDatabase(), "http://localhost:8080", tt.opts...)
+			tt.req.LongURL = "https://www.reddit.com/r/Fedora/"
+			resp, err := app.ShortenURL(ctx, tt.req)
+			if tt.err != nil {
+				assert.ErrorIs(t, err, tt.err)
+				return
+			}
+			assert.NoError(t, err)
+			tt.check(t, resp)
+			shortURL := strings.Split(resp.ShortURl, "/")
+			_, err = app.RedirectURL(ctx, shortURL[len(shortURL)-1])
+			assert.NoError(t, err)
+		})
+	}
+}
+
+// Test Redirection of URL after it has expired
+func TestURLShortenService_RedirectURLExpired(t *testing.T) {
+	db := database.NewInMemoryDatabase()
+	app := NewURLShortenService(db, "http://localhost:8080")
+	ctx := context.Background()
+	err := db.AddData(ctx, "OLD123", entities.ShortURLDBData{
+		LongURL:    "https://www.reddit.com/r/Fedora/",
+		ShortURl:   "OLD123",
+		CreatedAt:  time.Now().Add(-2 * time.Hour),
+		ExpiryDate: time.Now().Add(-time.Hour),
+	})
+	assert.NoError(t, err)
+	response, err := app.RedirectURL(ctx, "OLD123")
+	assert.Nil(t, response)
+	assert.ErrorIs(t, err, ErrExpired)
+}
+
+// Test that purging expired links lets the long URL be shortened afresh
+func TestURLShortenService_PurgeExpired(t *testing.T) {
+	db := database.NewInMemoryDatabase()
+	app := NewURLShortenService(db, "http://localhost:8080")
+	ctx := context.Background()
+	err := db.AddData(ctx, "OLD123", entities.ShortURLDBData{
+		LongURL:       "https://www.reddit.com/r/Fedora/",
+		LongURLDomain: "www.reddit.com",
+		ShortURl:      "OLD123",
+		CreatedAt:     time.Now().Add(-2 * time.Hour),
+		ExpiryDate:    time.Now().Add(-time.Hour),
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, 1, app.PurgeExpired(ctx))
+	assert.Nil(t, db.RetrieveData(ctx, "OLD123"))
+	resp, err := app.ShortenURL(ctx, entities.ShortenURLRequest{LongURL: "https://www.reddit.com/r/Fedora/"})
+	assert.NoError(t, err)
+	assert.NotEqual(t, "http://localhost:8080/OLD123", resp.ShortURl)
+	assert.True(t, resp.ExpiryDate.After(time.Now()))
+}
+
+// Test that re-shortening a URL whose link expired mints a new code
+func TestURLShortenService_ShortenURL_ExpiredIsReissued(t *testing.T) {
+	db := database.NewInMemoryDatabase()
+	app := NewURLShortenService(db, "http://localhost:8080")
+	ctx := context.Background()
+	err := db.AddData(ctx, "OLD123", entities.ShortURLDBData{
+		LongURL:    "https://www.reddit.com/r/Fedora/",
+		ShortURl:   "OLD123",
+		CreatedAt:  time.Now().Add(-2 * time.Hour),
+		ExpiryDate: time.Now().Add(-time.Hour),
+	})
+	assert.NoError(t, err)
+
+	req := entities.ShortenURLRequest{LongURL: "https://www.reddit.com/r/Fedora/"}
+	resp, err := app.ShortenURL(ctx, req)
+	assert.NoError(t, err)
+	assert.Equal(t, entities.LinkReissued, resp.Status)
+	assert.NotEqual(t, "http://localhost:8080/OLD123", resp.ShortURl)
+	assert.True(t, resp.ExpiryDate.After(time.Now()))
+	shortURL := strings.Split(resp.ShortURl, "/")
+	redirect, err := app.RedirectURL(ctx, shortURL[len(shortURL)-1])
+	assert.NoError(t, err)
+	assert.Equal(t, req.LongURL, redirect.LongURl)
+
+	// the fresh link is now the one handed out
+	resp2, err := app.ShortenURL(ctx, req)
+	assert.NoError(t, err)
+	assert.Equal(t, entities.LinkExisting, resp2.Status)
+	assert.Equal(t, resp.ShortURl, resp2.ShortURl)
+}
+
+// Test that the redirect type is chosen per link with a server wide default
+func TestURLShortenService_RedirectType(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name      string
+		requested int
+		opts      []Option
+		want      int
+		err       error
+	}{
+		{name: "default is permanent", want: http.StatusPermanentRedirect},
+		{name: "server default", opts: []Option{WithDefaultRedirect(http.StatusFound)}, want: http.StatusFound},
+		{name: "per link 301", requested: http.StatusMovedPermanently, want: http.StatusMovedPermanently},
+		{name: "per link 307 overrides default", requested: http.StatusTemporaryRedirect, opts: []Option{WithDefaultRedirect(http.StatusFound)}, want: http.StatusTemporaryRedirect},
+		{name: "not a redirect", requested: http.StatusOK, err: ErrInvalidRedirect},
+		{name: "unsupported redirect", requested: http.StatusSeeOther, err: ErrInvalidRedirect},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := NewURLShortenService(database.NewInMemoryDatabase(), "http://localhost:8080", tt.opts...)
+			resp, err := app.ShortenURL(ctx, entities.ShortenURLRequest{
+				LongURL:      "https://www.reddit.com/r/Fedora/",
+				RedirectType: tt.requested,
+			})
+			if tt.err != nil {
+				assert.ErrorIs(t, err, tt.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, resp.RedirectType)
+			shortURL := strings.Split(resp.ShortURl, "/")
+			redirect, err := app.RedirectURL(ctx, shortURL[len(shortURL)-1])
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, redirect.StatusCode)
+		})
+	}
+}
+
+// Test that links stored without a redirect type use the server default
+func TestURLShortenService_RedirectType_LegacyRecord(t *testing.T) {
+	db := database.NewInMemoryDatabase()
+	app := NewURLShortenService(db, "http://localhost:8080", WithDefaultRedirect(http.StatusFound))
+	ctx := context.Background()
+	assert.NoError(t, db.AddData(ctx, "LEGACY", entities.ShortURLDBData{
+		LongURL:  "https://www.reddit.com/r/Fedora/",
+		ShortURl: "LEGACY",
+	}))
+	redirect, err := app.RedirectURL(ctx, "LEGACY")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusFound, redirect.StatusCode)
+}
+
+// Test validation of the top domains query
+func TestURLShortenService_RetrieveTopDomains_Validation(t *testing.T) {
+	app := NewURLShortenService(database.NewInMemoryDatabase(), "http://localhost:8080")
+	ctx := context.Background()
+	for _, window := range []string{"", "all", "1h", "24h", "7d"} {
+		_, err := app.RetrieveTopDomains(ctx, 3, window)
+		assert.NoError(t, err, window)
+	}
+	_, err := app.RetrieveTopDomains(ctx, 3, "2h")
+	assert.ErrorIs(t, err, ErrInvalidWindow)
+	_, err = app.RetrieveTopDomains(ctx, 0, "")
+	assert.ErrorIs(t, err, ErrInvalidLimit)
+	_, err = app.RetrieveTopDomains(ctx, MaxTopDomainsLimit+1, "")
+	assert.ErrorIs(t, err, ErrInvalidLimit)
+}
+
+// Test that the service exports its counters on the injected registry
+func TestURLShortenService_Metrics(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	db := database.NewInMemoryDatabase()
+	app := NewURLShortenService(db, "http://localhost:8080", WithMetrics(reg))
+	ctx := context.Background()
+
+	// occupy the code the URL would hash to, forcing a collision
+	code := app.GenerateHashOfURL(ctx, "https://www.reddit.com/r/Fedora/")
+	assert.NoError(t, db.AddData(ctx, code, entities.ShortURLDBData{LongURL: "https://other.com", ShortURl: code}))
+	resp, err := app.ShortenURL(ctx, entities.ShortenURLRequest{LongURL: "https://www.reddit.com/r/Fedora/"})
+	assert.NoError(t, err)
+	shortURL := strings.Split(resp.ShortURl, "/")
+	_, err = app.RedirectURL(ctx, shortURL[len(shortURL)-1])
+	assert.NoError(t, err)
+	_, err = app.RedirectURL(ctx, "NOPE42")
+	assert.Error(t, err)
+
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP urlshortener_hash_collisions_total Short code collisions hit while generating codes.
+# TYPE urlshortener_hash_collisions_total counter
+urlshortener_hash_collisions_total 1
+# HELP urlshortener_links Links currently held by the store, expired ones included.
+# TYPE urlshortener_links gauge
+urlshortener_links 2
+# HELP urlshortener_links_created_total Short links created.
+# TYPE urlshortener_links_created_total counter
+urlshortener_links_created_total 1
+# HELP urlshortener_redirects_total Redirects served.
+# TYPE urlshortener_redirects_total counter
+urlshortener_redirects_total 1
+`)))
+}
+
+// Test WithCodeLength controls the length of generated codes
+func TestURLShortenService_WithCodeLength(t *testing.T) {
+	app := NewURLShortenService(database.NewInMemoryDatabase(), "http://localhost:8080", WithCodeLength(9))
+	resp, err := app.ShortenURL(context.Background(), entities.ShortenURLRequest{LongURL: "https://www.reddit.com/r/Fedora/"})
+	assert.NoError(t, err)
+	shortURL := strings.Split(resp.ShortURl, "/")
+	assert.Len(t, shortURL[len(shortURL)-1], 9)
+}
+
+// Test that the background jobs return once their context is cancelled
+func TestURLShortenService_BackgroundJobsStop(t *testing.T) {
+	app := NewURLShortenService(database.NewInMemoryDatabase(), "http://localhost:8080",
+		WithReapInterval(time.Millisecond), WithTopDomainsInterval(time.Millisecond))
+	for _, job := range []func(context.Context){app.PopulateTopDomains, app.ReapExpiredLinks, app.RecordClicks} {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			job(ctx)
+			close(done)
+		}()
+		time.Sleep(5 * time.Millisecond)
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("background job did not stop after cancellation")
+		}
+	}
+}
+
+// Test that links record the key that created them and aliases are only idempotent for their owner
+func TestURLShortenService_ShortenURL_Owner(t *testing.T) {
+	db := database.NewInMemoryDatabase()
+	app := NewURLShortenService(db, "http://localhost:8080")
+	ctx := context.Background()
+	req := entities.ShortenURLRequest{LongURL: "https://www.reddit.com/r/Fedora/", Alias: "fedora", Owner: "ci"}
+	_, err := app.ShortenURL(ctx, req)
+	assert.NoError(t, err)
+	assert.Equal(t, "ci", db.RetrieveData(ctx, "fedora").Owner)
+
+	resp, err := app.ShortenURL(ctx, req)
+	assert.NoError(t, err)
+	assert.Equal(t, entities.LinkExisting, resp.Status)
+	req.Owner = "ops"
+	_, err = app.ShortenURL(ctx, req)
+	assert.ErrorIs(t, err, ErrAliasTaken)
+}
+
+// Test that the URL policy is applied before anything is stored
+func TestURLShortenService_ShortenURL_Policy(t *testing.T) {
+	db := database.NewInMemoryDatabase()
+	app := NewURLShortenService(db, "https://sho.rt", WithURLPolicy(URLPolicy{Deny: []string{"*.reddit.com"}}), WithDomains("https://go.example.com"))
+	ctx := context.Background()
+
+	_, err := app.ShortenURL(ctx, entities.ShortenURLRequest{LongURL: "https://www.reddit.com/r/Fedora/"})
+	assert.ErrorIs(t, err, ErrBlockedURL)
+	_, err = app.ShortenURL(ctx, entities.ShortenURLRequest{LongURL: "https://sho.rt/abcdef"})
+	assert.ErrorIs(t, err, ErrBlockedURL, "redirect loop through our own domain")
+	_, err = app.ShortenURL(ctx, entities.ShortenURLRequest{LongURL: "https://go.example.com/abcdef"})
+	assert.ErrorIs(t, err, ErrBlockedURL, "redirect loop through another of our domains")
+	assert.Equal(t, 0, db.CountLinks(ctx))
+
+	_, err = app.ShortenURL(ctx, entities.ShortenURLRequest{LongURL: "https://www.wikipedia.org/"})
+	assert.NoError(t, err)
+}
+
+// Test that many concurrent creators get exactly one link per URL and alias,
+// whatever the code generator and store, without deadlocking the store.
+// Run with -race.
+func TestURLShortenService_ConcurrentCreators(t *testing.T) {
+	const creators, urls = 64, 20
+	for _, store := range database.Stores {
+		for _, generator := range CodeGenerators {
+			t.Run(store+"/"+generator, func(t *testing.T) {
+				db, err := database.Open(store, filepath.Join(t.TempDir(), "urls.db"))
+				require.NoError(t, err)
+				if closer, ok := db.(io.Closer); ok {
+					t.Cleanup(func() { _ = closer.Close() })
+				}
+				codes, err := NewCodeGenerator(generator, db)
+				require.NoError(t, err)
+				app := NewURLShortenService(db, "http://localhost:8080", WithCodeGenerator(codes))
+				ctx := context.Background()
+
+				shortURLs := make([][]string, creators)
+				start := make(chan struct{})
+				var wg sync.WaitGroup
+				for c := 0; c < creators; c++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						shortURLs[c] = make([]string, urls+1)
+						<-start
+						for i := 0; i < urls; i++ {
+							resp, err := app.ShortenURL(ctx, entities.ShortenURLRequest{LongURL: fmt.Sprintf("https://www.reddit.com/r/%d", i)})
+							if !assert.NoError(t, err) {
+								return
+							}
+							shortURLs[c][i] = resp.ShortURl
+						}
+						resp, err := app.ShortenURL(ctx, entities.ShortenURLRequest{LongURL: "https://www.reddit.com/r/Fedora/", Alias: "fedora"})
+						if assert.NoError(t, err, "a repeated alias request is idempotent under contention") {
+							shortURLs[c][urls] = resp.ShortURl
+						}
+					}()
+				}
+				close(start)
+				done := make(chan struct{})
+				go func() {
+					wg.Wait()
+					close(done)
+				}()
+				select {
+				case <-done:
+				case <-time.After(30 * time.Second):
+					t.Fatal("creators did not finish, the store is deadlocked")
+				}
+
+				assert.Equal(t, urls+1, db.CountLinks(ctx))
+				for c := 1; c < creators; c++ {
+					assert.Equal(t, shortURLs[0], shortURLs[c], "creator %d got other links", c)
+				}
+			})
+		}
+	}
 }
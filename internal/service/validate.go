@@ -0,0 +1,116 @@
+package service
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Limits of DNS names, RFC 1035 section 2.3.4.
+const maxHostnameLength = 253
+const maxLabelLength = 63
+
+// validateLongURL checks that a canonical long URL can be shortened: an
+// absolute http(s) URL without credentials whose host is a domain name, an
+// IPv4 address or a bracketed IPv6 address, with an optional port. Whether
+// such hosts and ports are welcome is up to the URLPolicy.
+func validateLongURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%w: scheme must be http or https", ErrInvalidURL)
+	}
+	if u.Opaque != "" {
+		return fmt.Errorf("%w: missing // after the scheme", ErrInvalidURL)
+	}
+	// https://bank.example@evil.example/ hides the real host from the reader
+	if u.User != nil {
+		return fmt.Errorf("%w: user information is not allowed", ErrInvalidURL)
+	}
+	if port := u.Port(); port != "" {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("%w: invalid port %q", ErrInvalidURL, port)
+		}
+	}
+	host := u.Hostname()
+	if strings.HasPrefix(u.Host, "[") {
+		ip := net.ParseIP(host)
+		if ip == nil || ip.To4() != nil && !strings.Contains(host, ":") {
+			return fmt.Errorf("%w: invalid IPv6 address %q", ErrInvalidURL, host)
+		}
+		return nil
+	}
+	if err := validateHostname(host); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidURL, err)
+	}
+	return nil
+}
+
+// validateHostname accepts dotted-quad IPv4 addresses and domain names of
+// at least two labels. localhost is let through for the URLPolicy to judge.
+// Names whose last label looks like a number are refused: browsers would
+// read hosts such as 0x7f.1 as IPv4 addresses.
+func validateHostname(host string) error {
+	if host == "" {
+		return fmt.Errorf("missing host")
+	}
+	if len(host) > maxHostnameLength {
+		return fmt.Errorf("host is longer than %d characters", maxHostnameLength)
+	}
+	labels := strings.Split(host, ".")
+	if numeric(labels[len(labels)-1]) {
+		if ip := net.ParseIP(host); ip == nil || ip.To4() == nil {
+			return fmt.Errorf("invalid IPv4 address %q", host)
+		}
+		return nil
+	}
+	if len(labels) < 2 && host != "localhost" {
+		return fmt.Errorf("host %q is not a fully qualified domain name", host)
+	}
+	for _, label := range labels {
+		if err := validateLabel(label); err != nil {
+			return fmt.Errorf("invalid host %q: %v", host, err)
+		}
+	}
+	return nil
+}
+
+// validateLabel checks one label of a lower-cased, punycode encoded name.
+// Underscores are tolerated as they appear in real-world host names.
+func validateLabel(label string) error {
+	if label == "" {
+		return fmt.Errorf("empty label")
+	}
+	if len(label) > maxLabelLength {
+		return fmt.Errorf("label is longer than %d characters", maxLabelLength)
+	}
+	if label[0] == '-' || label[len(label)-1] == '-' {
+		return fmt.Errorf("label %q starts or ends with a hyphen", label)
+	}
+	for i := 0; i < len(label); i++ {
+		c := label[i]
+		if !('a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_') {
+			return fmt.Errorf("label %q contains %q", label, c)
+		}
+	}
+	return nil
+}
+
+// numeric reports whether label is a decimal or 0x hexadecimal number.
+func numeric(label string) bool {
+	digits := label
+	hex := false
+	if strings.HasPrefix(label, "0x") {
+		digits, hex = label[2:], true
+	}
+	if digits == "" {
+		return hex
+	}
+	for i := 0; i < len(digits); i++ {
+		c := digits[i]
+		if !('0' <= c && c <= '9' || hex && 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}